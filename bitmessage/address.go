@@ -0,0 +1,320 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+// This file implements BitMessage identities and the encoding of their
+// addresses in the "BM-" format.
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	encVarint "github.com/nictuku/guardian/encoding/varint"
+)
+
+const (
+	// Version of the addresses created by this package, the same as
+	// PyBitmessage creates.
+	addressVersion = 4
+	// Number of leading zero bytes demanded from the ripe hash of new
+	// addresses. They are not encoded, so the address gets shorter.
+	ripeNullBytes = 1
+
+	addressPrefix  = "BM-"
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+var (
+	ErrAddressChecksum = errors.New("bitmessage: address checksum mismatch")
+	ErrAddressVersion  = errors.New("bitmessage: unsupported address version")
+	ErrAddressFormat   = errors.New("bitmessage: malformed address")
+)
+
+// Address identifies the owner of a pair of signing and encryption keys. Its
+// string form is what people exchange, for example:
+// BM-2DAV89w336ovy6BUJnfVRD5B9qipFbRgmr.
+type Address struct {
+	Version uint64
+	Stream  uint64
+	// Ripe is the Bitmessage() hash of the public signing key followed by
+	// the public encryption key.
+	Ripe [20]byte
+}
+
+// String encodes the address version, stream and ripe followed by a checksum
+// in base58, prefixed with "BM-".
+func (a Address) String() string {
+	ripe := a.Ripe[:]
+	switch {
+	case a.Version >= 4:
+		ripe = bytes.TrimLeft(ripe, "\x00")
+	case a.Version >= 2:
+		// Older versions only strip up to two zero bytes.
+		if bytes.HasPrefix(ripe, []byte{0, 0}) {
+			ripe = ripe[2:]
+		} else if ripe[0] == 0 {
+			ripe = ripe[1:]
+		}
+	}
+	buf := new(bytes.Buffer)
+	encVarint.WriteVarInt(buf, a.Version)
+	encVarint.WriteVarInt(buf, a.Stream)
+	buf.Write(ripe)
+	buf.Write(addressChecksum(buf.Bytes()))
+	return addressPrefix + base58Encode(buf.Bytes())
+}
+
+// DecodeAddress parses a BM- address, verifying its checksum. The "BM-"
+// prefix is optional.
+func DecodeAddress(s string) (a Address, err error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), addressPrefix)
+	data, err := base58Decode(s)
+	if err != nil {
+		return a, err
+	}
+	if len(data) < 4 {
+		return a, ErrAddressFormat
+	}
+	data, checksum := data[:len(data)-4], data[len(data)-4:]
+	if !bytes.Equal(addressChecksum(data), checksum) {
+		return a, ErrAddressChecksum
+	}
+	r := bytes.NewBuffer(data)
+	if a.Version, _, err = encVarint.ReadVarInt(r); err != nil {
+		return a, ErrAddressFormat
+	}
+	if a.Version < 2 || a.Version > 4 {
+		return a, ErrAddressVersion
+	}
+	if a.Stream, _, err = encVarint.ReadVarInt(r); err != nil {
+		return a, ErrAddressFormat
+	}
+	ripe := r.Bytes()
+	switch {
+	case len(ripe) > len(a.Ripe):
+		return a, ErrAddressFormat
+	case a.Version >= 4 && (len(ripe) < 4 || ripe[0] == 0):
+		// Version 4 addresses have all leading zeroes stripped.
+		return a, ErrAddressFormat
+	case a.Version < 4 && len(ripe) < len(a.Ripe)-2:
+		return a, ErrAddressFormat
+	}
+	copy(a.Ripe[len(a.Ripe)-len(ripe):], ripe)
+	return a, nil
+}
+
+// addressChecksum returns the first 4 bytes of the double SHA-512 hash of
+// data.
+func addressChecksum(data []byte) []byte {
+	h, _ := doubleHash(data)
+	return h[:4]
+}
+
+// base58Encode encodes b as a big-endian number using the base58 alphabet.
+// Like in PyBitmessage, leading zero bytes are not preserved.
+func base58Encode(b []byte) string {
+	var (
+		x    = new(big.Int).SetBytes(b)
+		base = big.NewInt(58)
+		mod  = new(big.Int)
+		out  []byte
+	)
+	for x.Sign() > 0 {
+		x.DivMod(x, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	x := new(big.Int)
+	base := big.NewInt(58)
+	for _, c := range []byte(s) {
+		i := strings.IndexByte(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("bitmessage: invalid base58 character %q", c)
+		}
+		x.Mul(x, base)
+		x.Add(x, big.NewInt(int64(i)))
+	}
+	return x.Bytes(), nil
+}
+
+// broadcastKey derives the private key used to encrypt version 2 broadcasts
+// from a. Anyone that knows the address can derive it, but the network at
+// large can't read the broadcasts.
+func broadcastKey(a Address) *btcec.PrivateKey {
+	buf := new(bytes.Buffer)
+	encVarint.WriteVarInt(buf, a.Version)
+	encVarint.WriteVarInt(buf, a.Stream)
+	buf.Write(a.Ripe[:])
+	h := sha512.Sum512(buf.Bytes())
+	k, _ := btcec.PrivKeyFromBytes(btcec.S256(), h[:32])
+	return k
+}
+
+// addressKeys derives from a the private key that encrypts its version 4
+// pubkeys, and the tag that identifies them on the network. Like for
+// broadcasts, only those who know the address can read them.
+func addressKeys(a Address) (*btcec.PrivateKey, [32]byte) {
+	buf := new(bytes.Buffer)
+	encVarint.WriteVarInt(buf, a.Version)
+	encVarint.WriteVarInt(buf, a.Stream)
+	buf.Write(a.Ripe[:])
+	h, _ := doubleHash(buf.Bytes())
+	k, _ := btcec.PrivKeyFromBytes(btcec.S256(), h[:32])
+	var tag [32]byte
+	copy(tag[:], h[32:])
+	return k, tag
+}
+
+// tag returns the tag of a. See addressKeys.
+func (a Address) tag() [32]byte {
+	_, tag := addressKeys(a)
+	return tag
+}
+
+// Identity is one of our own addresses, along with the private keys needed to
+// sign and decrypt its messages.
+type Identity struct {
+	Address
+	SigningKey    *btcec.PrivateKey
+	EncryptionKey *btcec.PrivateKey
+	// Chan is the name of the chan whose keys are shared by its members,
+	// or empty for identities that belong only to us. See JoinChan.
+	Chan string
+}
+
+// NewIdentity creates an identity for the given stream with random keys.
+func NewIdentity(stream uint64) (*Identity, error) {
+	signingKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	// Only the encryption key is regenerated until the ripe has the required
+	// amount of leading zeroes, just like PyBitmessage does.
+	for {
+		encryptionKey, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return nil, err
+		}
+		id := newIdentity(signingKey, encryptionKey, stream)
+		if hasRipeNullBytes(id.Ripe) {
+			return id, nil
+		}
+	}
+}
+
+// NewDeterministicIdentity derives an identity for the given stream from a
+// passphrase, so it can be recreated anywhere that passphrase is known. The
+// result is compatible with deterministic addresses from PyBitmessage.
+func NewDeterministicIdentity(passphrase string, stream uint64) (*Identity, error) {
+	if passphrase == "" {
+		return nil, errors.New("bitmessage: empty passphrase")
+	}
+	// Each attempt hashes the passphrase with a new pair of nonces until the
+	// resulting keys produce a ripe with enough leading zeroes.
+	for signingNonce := uint64(0); ; signingNonce += 2 {
+		signingKey := deterministicKey(passphrase, signingNonce)
+		encryptionKey := deterministicKey(passphrase, signingNonce+1)
+		id := newIdentity(signingKey, encryptionKey, stream)
+		if hasRipeNullBytes(id.Ripe) {
+			return id, nil
+		}
+	}
+}
+
+// deterministicKey returns the private key formed by the first 32 bytes of
+// SHA-512(passphrase + varint(nonce)).
+func deterministicKey(passphrase string, nonce uint64) *btcec.PrivateKey {
+	buf := bytes.NewBufferString(passphrase)
+	encVarint.WriteVarInt(buf, nonce)
+	h := sha512.Sum512(buf.Bytes())
+	k, _ := btcec.PrivKeyFromBytes(btcec.S256(), h[:32])
+	return k
+}
+
+// PubKey returns the public part of id, as published to the network.
+func (id *Identity) PubKey() *PubKey {
+	k := &PubKey{
+		Time:                uint64(time.Now().Unix()),
+		AddressVersion:      id.Version,
+		StreamNumber:        id.Stream,
+		Behavior:            behaviorDoesAck,
+		PublicSigningKey:    pubKeyBytes(id.SigningKey.PubKey()),
+		PublicEncryptionKey: pubKeyBytes(id.EncryptionKey.PubKey()),
+		NonceTrialsPerByte:  averageProofOfWorkNonceTrialsPerByte,
+		ExtraBytes:          payloadLengthExtraBytes,
+	}
+	if id.Version >= 4 {
+		k.Tag = id.tag()
+	}
+	return k
+}
+
+func newIdentity(signingKey, encryptionKey *btcec.PrivateKey, stream uint64) *Identity {
+	return &Identity{
+		Address: Address{
+			Version: addressVersion,
+			Stream:  stream,
+			Ripe:    pubKeysRipe(pubKeyBytes(signingKey.PubKey()), pubKeyBytes(encryptionKey.PubKey())),
+		},
+		SigningKey:    signingKey,
+		EncryptionKey: encryptionKey,
+	}
+}
+
+func hasRipeNullBytes(ripe [20]byte) bool {
+	for _, b := range ripe[:ripeNullBytes] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pubKeysRipe calculates the ripe hash that identifies an address from its
+// public keys.
+func pubKeysRipe(signingKey, encryptionKey [64]byte) (ripe [20]byte) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(0x04)
+	buf.Write(signingKey[:])
+	buf.WriteByte(0x04)
+	buf.Write(encryptionKey[:])
+	h, _ := Bitmessage(buf.Bytes())
+	copy(ripe[:], h)
+	return ripe
+}
+
+// pubKeyBytes serializes a public key in the uncompressed format used by the
+// wire protocol, without the \x04 prefix.
+func pubKeyBytes(k *btcec.PublicKey) (b [64]byte) {
+	copy(b[:], k.SerializeUncompressed()[1:])
+	return b
+}
+
+// pubKeyFromBytes is the inverse of pubKeyBytes.
+func pubKeyFromBytes(b [64]byte) (*btcec.PublicKey, error) {
+	return btcec.ParsePubKey(append([]byte{0x04}, b[:]...), btcec.S256())
+}
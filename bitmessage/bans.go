@@ -0,0 +1,143 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// This file implements the ban scores of remote nodes. Nodes that break the
+// protocol or abuse us get points, and hosts that reach banThreshold are
+// banned for BanDuration. Methods of Node can only be executed by the main
+// server routine.
+
+// misbehavior is an error caused by a remote node breaking the protocol or
+// abusing us. Its score is added to the ban score of the node's host.
+type misbehavior struct {
+	score int
+	err   error
+}
+
+func (m misbehavior) Error() string {
+	return m.err.Error()
+}
+
+func (m misbehavior) Unwrap() error {
+	return m.err
+}
+
+// misbehaving returns an error that adds score to the ban score of the node
+// that caused it.
+func misbehaving(score int, err error) error {
+	return misbehavior{score, err}
+}
+
+// misbehaviorScore returns the ban score caused by err, which is zero for
+// errors that aren't the remote node's fault.
+func misbehaviorScore(err error) int {
+	var m misbehavior
+	if errors.As(err, &m) {
+		return m.score
+	}
+	return 0
+}
+
+// nodeMisbehavior is sent by the connection handlers when a remote node
+// misbehaves.
+type nodeMisbehavior struct {
+	from  ipPort
+	score int
+}
+
+// banScore is the accumulated score of a host, and when it last misbehaved.
+type banScore struct {
+	score int
+	last  time.Time
+}
+
+// banSet holds the banned hosts, with the time their bans expire. Unlike
+// unreachableSet, it's keyed by host, so a banned node can't come back from
+// another port.
+type banSet map[string]time.Time
+
+func (b banSet) add(host string) {
+	b[host] = time.Now().Add(BanDuration)
+}
+
+func (b banSet) test(host string) bool {
+	expires, ok := b[host]
+	return ok && time.Now().Before(expires)
+}
+
+// expire removes the entries that expired.
+func (b banSet) expire() {
+	now := time.Now()
+	for host, expires := range b {
+		if !now.Before(expires) {
+			delete(b, host)
+		}
+	}
+}
+
+// host returns the IP part of ipPort.
+func (ipPort ipPort) host() string {
+	host, _, err := net.SplitHostPort(string(ipPort))
+	if err != nil {
+		return string(ipPort)
+	}
+	return host
+}
+
+// banned returns whether the host of ipPort is banned.
+func (n *Node) banned(ipPort ipPort) bool {
+	return n.bannedNodes.test(ipPort.host())
+}
+
+// misbehaved adds to the ban score of the node's host. Once the score
+// reaches banThreshold, the host is banned and all connections to it are
+// closed.
+func (n *Node) misbehaved(m nodeMisbehavior) {
+	host := m.from.host()
+	s := n.banScores[host]
+	s.score += m.score
+	s.last = time.Now()
+	if s.score < banThreshold {
+		n.banScores[host] = s
+		return
+	}
+	delete(n.banScores, host)
+	n.bannedNodes.add(host)
+	log.Printf("banning %v for %v, ban score %d", host, BanDuration, s.score)
+	for _, nodes := range n.connectedNodes {
+		for ipPort, node := range nodes {
+			if ipPort.host() == host && node.conn != nil {
+				// The connection handler notices and removes the node.
+				node.conn.Close()
+			}
+		}
+	}
+}
+
+// expireBanScores forgets the scores of hosts that behaved for banScoreTTL.
+func (n *Node) expireBanScores() {
+	for host, s := range n.banScores {
+		if time.Since(s.last) >= banScoreTTL {
+			delete(n.banScores, host)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMisbehaviorScore(t *testing.T) {
+	badChecksum := []byte("\xe9\xbe\xb4\xd9badcheck\x00\x00\x00\x00" +
+		"\x00\x00\x00\x05" +
+		"\x50\x54\x0b\xFF" +
+		"\x01\x02\x03\x04\x05")
+	_, err := readMessage(bytes.NewReader(badChecksum))
+	if s := misbehaviorScore(err); s != banScoreBadChecksum {
+		t.Errorf("bad checksum scored %d, wanted %d", s, banScoreBadChecksum)
+	}
+	err = fmt.Errorf("handleMsg parseMsg error: %w", checkProofOfWork([]byte("x"), [8]byte{}))
+	if s := misbehaviorScore(err); s != banScoreInvalidPoW {
+		t.Errorf("invalid PoW scored %d, wanted %d", s, banScoreInvalidPoW)
+	}
+	p := &peerState{verackReceived: true}
+	if s := misbehaviorScore(handleVerack(new(bytes.Buffer), p, nil)); s != banScoreDuplicateHandshake {
+		t.Errorf("duplicate verack scored %d, wanted %d", s, banScoreDuplicateHandshake)
+	}
+	if s := misbehaviorScore(fmt.Errorf("stream ended")); s != 0 {
+		t.Errorf("plain error scored %d, wanted 0", s)
+	}
+}
+
+func TestMisbehaved(t *testing.T) {
+	n := &Node{
+		connectedNodes:   make(streamNodes),
+		knownNodes:       make(streamNodes),
+		dialing:          make(map[ipPort]bool),
+		unreachableNodes: make(unreachableSet),
+		bannedNodes:      make(banSet),
+		banScores:        make(map[string]banScore),
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	n.addNode(streamOne, "10.1.0.1:8444", remoteNode{conn: local})
+	n.learnNode(streamOne, "10.1.0.1:8444", time.Now())
+
+	n.misbehaved(nodeMisbehavior{"10.1.0.1:8444", banThreshold - 1})
+	if n.banned("10.1.0.1:8444") {
+		t.Fatalf("node banned below the threshold")
+	}
+	// The score is kept per host, so it adds up across ports.
+	n.misbehaved(nodeMisbehavior{"10.1.0.1:50000", 1})
+	if !n.banned("10.1.0.1:8444") {
+		t.Fatalf("node not banned after reaching the threshold")
+	}
+	if _, err := local.Write([]byte{0}); err == nil {
+		t.Errorf("connection to the banned node wasn't closed")
+	}
+	if c := n.peerCandidates(streamOne, 1); len(c) != 0 {
+		t.Errorf("banned node is a peer candidate: %v", c)
+	}
+	if len(n.banScores) != 0 {
+		t.Errorf("ban score kept after the ban: %v", n.banScores)
+	}
+}
+
+func TestBanSet(t *testing.T) {
+	b := make(banSet)
+	b.add("10.0.0.1")
+	b["10.0.0.2"] = time.Now().Add(-time.Second)
+	if !b.test("10.0.0.1") {
+		t.Errorf("banned host not found")
+	}
+	if b.test("10.0.0.2") || b.test("10.0.0.3") {
+		t.Errorf("host found after its ban expired, or without a ban")
+	}
+	b.expire()
+	if _, ok := b["10.0.0.2"]; ok {
+		t.Errorf("expired ban not removed")
+	}
+	if ipPort("[::1]:8444").host() != "::1" {
+		t.Errorf("host of an IPv6 ipPort is %q", ipPort("[::1]:8444").host())
+	}
+}
@@ -0,0 +1,88 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+// This file implements chans: group conversations on a deterministic address
+// derived from the chan name. Every member knows the private keys, so they
+// all receive the msgs sent to the chan, and posting to a chan is sending a
+// msg from the chan address to itself. This is compatible with PyBitmessage.
+
+import (
+	"fmt"
+)
+
+// JoinChan makes the node receive the messages sent to the chan with the given
+// name, in stream one. It returns the identity of the chan, whose address can
+// be shared with people that don't know the name. Like in PyBitmessage, it's
+// a version 4 address.
+func (n *Node) JoinChan(name string) (*Identity, error) {
+	id, err := NewDeterministicIdentity(name, streamOne)
+	if err != nil {
+		return nil, err
+	}
+	id.Version = 4
+	id.Chan = name
+	n.AddIdentity(id)
+	return id, nil
+}
+
+// LeaveChan stops the delivery of messages sent to the chan with the given
+// name.
+func (n *Node) LeaveChan(name string) error {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	id := n.findChan(name)
+	if id == nil {
+		return fmt.Errorf("bitmessage: not a member of chan %q", name)
+	}
+	delete(n.mailbox.identities, id.Ripe)
+	delete(n.mailbox.mailingLists, id.Ripe)
+	return nil
+}
+
+// Chans returns the identities of the chans the node is a member of.
+func (n *Node) Chans() []*Identity {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	var chans []*Identity
+	for _, id := range n.mailbox.identities {
+		if id.Chan != "" {
+			chans = append(chans, id)
+		}
+	}
+	return chans
+}
+
+// PostToChan queues a message to all members of a chan we joined. It returns
+// the ID of the message in the Outbox, like Send.
+func (n *Node) PostToChan(name string, encoding uint64, subject, body string) (int, error) {
+	n.mailbox.Lock()
+	id := n.findChan(name)
+	n.mailbox.Unlock()
+	if id == nil {
+		return 0, fmt.Errorf("bitmessage: not a member of chan %q", name)
+	}
+	return n.Send(id.Address, id.String(), encoding, subject, body)
+}
+
+// findChan finds the identity of a chan by name. The mailbox lock must be held.
+func (n *Node) findChan(name string) *Identity {
+	for _, id := range n.mailbox.identities {
+		if id.Chan == name && name != "" {
+			return id
+		}
+	}
+	return nil
+}
@@ -61,13 +61,41 @@ func writeVerack(w io.Writer) {
 }
 
 // Provide information on known nodes of the network. Non-advertised nodes
-// should be forgotten after typically 3 hours.
-// func writeAddr
+// should be forgotten after typically 3 hours. Nothing is sent if addrs is
+// empty, and lists longer than maxAddrEntries are split in several messages.
+func writeAddr(w io.Writer, addrs []extendedNetworkAddress) {
+	for len(addrs) > 0 {
+		batch := addrs
+		if len(batch) > maxAddrEntries {
+			batch = batch[:maxAddrEntries]
+		}
+		addrs = addrs[len(batch):]
+		buf := new(bytes.Buffer)
+		check(writeNetworkAddressList(buf, batch))
+		writeMessage(w, "addr", buf.Bytes())
+	}
+}
 
 // InvMessage allows a node to advertise its knowledge of one or more objects.
 // It can be received unsolicited, or in reply to getmessages.
-// Maximum payload length: 50000 items.
-// func writeInv
+// Maximum payload length: 50000 items, so longer lists are split in several
+// messages.
+func writeInv(w io.Writer, hashes []objHash) {
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > maxInventoryEntries {
+			batch = batch[:maxInventoryEntries]
+		}
+		hashes = hashes[len(batch):]
+		invs := make([]inventoryVector, len(batch))
+		for i, h := range batch {
+			invs[i] = inventoryVector{h}
+		}
+		buf := new(bytes.Buffer)
+		check(writeInventoryVector(buf, invs))
+		writeMessage(w, "inv", buf.Bytes())
+	}
+}
 
 // getdata is used in response to an inv message to retrieve the content of a specific object after filtering known elements.
 // Payload (maximum payload length: 50000 entries).
@@ -20,6 +20,7 @@ package bitmessage
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -35,10 +36,16 @@ type Config struct {
 
 	path  string // Empty if the store is disabled.
 	Nodes []ipPort
+	// Unreachable are the nodes that can't be reached, with the time their
+	// entries expire.
+	Unreachable unreachableSet
+	// Banned are the hosts banned for misbehaving, with the time their bans
+	// expire.
+	Banned banSet
 }
 
 // saveConfig tries to safe the provided config in a safe way.
-func (s *Config) save(connectedNodes streamNodes) {
+func (s *Config) save(connectedNodes streamNodes, unreachable unreachableSet, banned banSet) {
 	s.Lock()
 	defer s.Unlock()
 	if s.path == "" {
@@ -51,44 +58,65 @@ func (s *Config) save(connectedNodes streamNodes) {
 			s.Nodes = append(s.Nodes, addr)
 		}
 	}
+	s.Unreachable = unreachable
+	s.Banned = banned
 
-	tmp, err := ioutil.TempFile(s.path, id)
+	p := fmt.Sprintf("%v-%v", path.Join(s.path, prefix), s.Port)
+	err := saveFile(p, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(s)
+	})
 	if err != nil {
-		log.Println("saveConfig tempfile:", err)
+		log.Println("saveConfig:", err)
 		return
 	}
-	err = json.NewEncoder(tmp).Encode(s)
+	log.Printf("Saved bitz state to the filesystem at %v.", p)
+}
+
+// inventoryPath is where the objects inventory is saved.
+func (s *Config) inventoryPath() string {
+	return fmt.Sprintf("%v-%v-inventory", path.Join(s.path, prefix), s.Port)
+}
+
+// objectsPath is the directory of the objects stored on disk.
+func (s *Config) objectsPath() string {
+	return fmt.Sprintf("%v-%v-objects", path.Join(s.path, prefix), s.Port)
+}
+
+// saveFile replaces the file at p with the output of encode, in a safe way.
+func saveFile(p string, encode func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(path.Dir(p), id)
+	if err != nil {
+		return fmt.Errorf("tempfile: %v", err)
+	}
+	err = encode(tmp)
 	// The file has to be closed already otherwise it can't be renamed on
 	// Windows.
 	tmp.Close()
 	if err != nil {
-		log.Println("saveConfig json encoding:", err)
-		return
+		os.Remove(tmp.Name())
+		return fmt.Errorf("encoding: %v", err)
 	}
 
 	// Write worked, so replace the existing file. That's atomic in Linux, but
 	// not on Windows.
-	p := fmt.Sprintf("%v-%v", path.Join(s.path, prefix), s.Port)
 	if err := os.Rename(tmp.Name(), p); err != nil {
 		// Doesn't work on Windows:
 		// if os.IsExist(err) {
 		// It's not possible to atomically rename files on Windows, so I
 		// have to delete it and try again. If the program crashes between
-		// the unlink and the rename operation, the config should be
+		// the unlink and the rename operation, the file should be
 		// available in the temp path.
 
 		// TODO: Use a static temp path and always try to recover from it
 		// during openConfig().
 		if err := os.Remove(p); err != nil {
-			log.Println("saveConfig failed to remove the existing config:", err)
-			return
+			return fmt.Errorf("failed to remove the existing file: %v", err)
 		}
 		if err := os.Rename(tmp.Name(), p); err != nil {
-			log.Println("saveConfig failed to rename file after deleting the original config:", err)
-			return
+			return fmt.Errorf("failed to rename file after deleting the original: %v", err)
 		}
 	}
-	log.Printf("Saved bitz state to the filesystem at %v.", p)
+	return nil
 }
 
 // mkdirConfig() creates a directory to load and save the configuration from.
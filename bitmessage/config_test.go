@@ -0,0 +1,46 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConfigSaveNodeSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitz-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+
+	cfg := openConfig(1234)
+	u := make(unreachableSet)
+	u.add("10.0.0.1:8444")
+	b := make(banSet)
+	b.add("10.0.0.2")
+	cfg.save(make(streamNodes), u, b)
+
+	cfg = openConfig(1234)
+	if !cfg.Unreachable.test("10.0.0.1:8444") {
+		t.Errorf("unreachable node not saved with the config: %v", cfg.Unreachable)
+	}
+	if !cfg.Banned.test("10.0.0.2") {
+		t.Errorf("banned host not saved with the config: %v", cfg.Banned)
+	}
+}
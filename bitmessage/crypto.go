@@ -0,0 +1,212 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+// This file implements the cryptographic primitives used by BitMessage over
+// the secp256k1 curve: ECDSA signatures and ECIES encryption.
+//
+// Signatures are DER encoded and made over the SHA-1 hash of the data, which
+// is what pyelliptic, the library used by PyBitmessage, does by default.
+//
+// The ECIES scheme is byte compatible with pyelliptic:
+//
+//	IV (16 bytes) used for AES-256-CBC.
+//	Ephemeral public key: curve type (0x02CA for secp256k1), X length, X,
+//	  Y length, Y. Lengths are uint16.
+//	Cipher text, with PKCS#7 padding.
+//	HMAC-SHA256 (32 bytes) of everything above.
+//
+// Keys are derived from the SHA-512 hash of the X coordinate of the ECDH
+// shared point: the first 32 bytes are the AES key, the last 32 bytes are the
+// HMAC key.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+const curveSecp256k1 = 0x02CA
+
+var (
+	errInvalidMAC       = errors.New("ECIES message authentication failed")
+	errInvalidSignature = errors.New("invalid ECDSA signature")
+)
+
+// eciesKeys derives the encryption and MAC keys shared between priv and pub.
+func eciesKeys(priv *btcec.PrivateKey, pub *btcec.PublicKey) (keyE, keyM []byte) {
+	x, _ := btcec.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	h := sha512.Sum512(paddedBytes(x, 32))
+	return h[:32], h[32:]
+}
+
+// encrypt encodes plaintext so that only the owner of pub can read it.
+func encrypt(pub *btcec.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	keyE, keyM := eciesKeys(ephemeral, pub)
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(iv)
+	putUint16(buf, curveSecp256k1)
+	putUint16(buf, 32)
+	putBytes(buf, paddedBytes(ephemeral.PublicKey.X, 32))
+	putUint16(buf, 32)
+	putBytes(buf, paddedBytes(ephemeral.PublicKey.Y, 32))
+
+	// PKCS#7 padding.
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, err := aes.NewCipher(keyE)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	putBytes(buf, padded)
+
+	mac := hmac.New(sha256.New, keyM)
+	mac.Write(buf.Bytes())
+	putBytes(buf, mac.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// decrypt decodes data that was encrypted to the public key of priv. It fails
+// with errInvalidMAC if the data was meant for another key.
+func decrypt(priv *btcec.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize+sha256.Size {
+		return nil, errors.New("ECIES data too short")
+	}
+	r := bytes.NewReader(data[aes.BlockSize : len(data)-sha256.Size])
+	var curve uint16
+	if err := binary.Read(r, binary.BigEndian, &curve); err != nil {
+		return nil, err
+	}
+	if curve != curveSecp256k1 {
+		return nil, errors.New("ECIES unsupported curve")
+	}
+	x, err := readCoordinate(r)
+	if err != nil {
+		return nil, err
+	}
+	y, err := readCoordinate(r)
+	if err != nil {
+		return nil, err
+	}
+	if !btcec.S256().IsOnCurve(x, y) {
+		return nil, errors.New("ECIES ephemeral key not on the curve")
+	}
+	keyE, keyM := eciesKeys(priv, &btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y})
+
+	mac := hmac.New(sha256.New, keyM)
+	mac.Write(data[:len(data)-sha256.Size])
+	if !hmac.Equal(mac.Sum(nil), data[len(data)-sha256.Size:]) {
+		return nil, errInvalidMAC
+	}
+
+	ciphertext := data[len(data)-sha256.Size-r.Len() : len(data)-sha256.Size]
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("ECIES ciphertext is not a multiple of the block size")
+	}
+	block, err := aes.NewCipher(keyE)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plaintext, ciphertext)
+
+	// Remove the PKCS#7 padding.
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("ECIES invalid padding")
+	}
+	for _, b := range plaintext[len(plaintext)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("ECIES invalid padding")
+		}
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
+
+// sign produces the DER encoded ECDSA signature of data.
+func sign(priv *btcec.PrivateKey, data []byte) ([]byte, error) {
+	h := sha1.Sum(data)
+	sig, err := priv.Sign(h[:])
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// verify checks that signature was made over data with the private key that
+// corresponds to signingKey. Newer clients sign the SHA-256 hash of the data
+// instead of SHA-1, so both are accepted.
+func verify(signingKey [64]byte, data, signature []byte) error {
+	pub, err := pubKeyFromBytes(signingKey)
+	if err != nil {
+		return err
+	}
+	sig, err := btcec.ParseSignature(signature, btcec.S256())
+	if err != nil {
+		return err
+	}
+	h1 := sha1.Sum(data)
+	if sig.Verify(h1[:], pub) {
+		return nil
+	}
+	h256 := sha256.Sum256(data)
+	if sig.Verify(h256[:], pub) {
+		return nil
+	}
+	return errInvalidSignature
+}
+
+func readCoordinate(r *bytes.Reader) (*big.Int, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > 32 || int(length) > r.Len() {
+		return nil, errors.New("ECIES invalid coordinate length")
+	}
+	b := make([]byte, length)
+	r.Read(b)
+	return new(big.Int).SetBytes(b), nil
+}
+
+// paddedBytes returns the big-endian bytes of x, left padded with zeroes to
+// size bytes.
+func paddedBytes(x *big.Int, size int) []byte {
+	b := x.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
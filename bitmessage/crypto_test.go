@@ -0,0 +1,185 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+func TestDecrypt(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("Subject:hello\nBody:world")
+	// btcec implements the same pyelliptic compatible format, but it doesn't
+	// pad the shared secret, so only secrets without leading zeros are used.
+	var encrypted []byte
+	for {
+		if encrypted, err = btcec.Encrypt(priv.PubKey(), want); err != nil {
+			t.Fatal(err)
+		}
+		ephemeral := &btcec.PublicKey{
+			Curve: btcec.S256(),
+			X:     new(big.Int).SetBytes(encrypted[20:52]),
+			Y:     new(big.Int).SetBytes(encrypted[54:86]),
+		}
+		if len(btcec.GenerateSharedSecret(priv, ephemeral)) == 32 {
+			break
+		}
+	}
+	got, err := decrypt(priv, encrypted)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("decrypt wanted %q, got %q", want, got)
+	}
+	if _, err := decrypt(other, encrypted); err != errInvalidMAC {
+		t.Errorf("decrypt with the wrong key wanted %v, got %v", errInvalidMAC, err)
+	}
+	if _, err := decrypt(priv, encrypted[:40]); err == nil {
+		t.Errorf("decrypt accepted truncated data")
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]byte{{}, []byte("0123456789abcdef"), []byte("hello world")} {
+		encrypted, err := encrypt(priv.PubKey(), want)
+		if err != nil {
+			t.Fatalf("encrypt: %v", err)
+		}
+		got, err := decrypt(priv, encrypted)
+		if err != nil {
+			t.Fatalf("decrypt: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("decrypt wanted %q, got %q", want, got)
+		}
+		// btcec doesn't pad the shared secret, so it can only read the
+		// data when the secret has no leading zeros.
+		ephemeral := &btcec.PublicKey{
+			Curve: btcec.S256(),
+			X:     new(big.Int).SetBytes(encrypted[20:52]),
+			Y:     new(big.Int).SetBytes(encrypted[54:86]),
+		}
+		if len(btcec.GenerateSharedSecret(priv, ephemeral)) < 32 {
+			continue
+		}
+		if got, err = btcec.Decrypt(priv, encrypted); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("btcec.Decrypt wanted %q, got %q (err %v)", want, got, err)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	id, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pubKeyBytes(id.SigningKey.PubKey())
+	data := []byte("hello")
+	sig, err := sign(id.SigningKey, data)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := verify(key, data, sig); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if err := verify(key, []byte("hellO"), sig); err != errInvalidSignature {
+		t.Errorf("verify of tampered data wanted %v, got %v", errInvalidSignature, err)
+	}
+	other := pubKeyBytes(id.EncryptionKey.PubKey())
+	if err := verify(other, data, sig); err != errInvalidSignature {
+		t.Errorf("verify with the wrong key wanted %v, got %v", errInvalidSignature, err)
+	}
+
+	// Newer clients sign SHA-256 hashes.
+	h := sha256.Sum256(data)
+	s256, err := id.SigningKey.Sign(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(key, data, s256.Serialize()); err != nil {
+		t.Errorf("verify of SHA-256 signature: %v", err)
+	}
+}
+
+func TestBroadcastVerify(t *testing.T) {
+	id, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := id.PubKey()
+	b := &broadcast{
+		BroadcastVersion:    1,
+		AddressVersion:      id.Version,
+		StreamNumber:        id.Stream,
+		Behavior:            1,
+		PublicSigningKey:    pub.PublicSigningKey,
+		PublicEncryptionKey: pub.PublicEncryptionKey,
+		NonceTrialsPerByte:  pub.NonceTrialsPerByte,
+		ExtraBytes:          pub.ExtraBytes,
+		AddressHash:         id.Ripe,
+		Encoding:            EncodingTrivial,
+		Message:             []byte("hello"),
+	}
+	if b.Signature, err = sign(id.SigningKey, b.signedData()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.verify(); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	b.Message = []byte("hellO")
+	if err := b.verify(); err == nil {
+		t.Errorf("verify accepted a tampered message")
+	}
+	b.Message = []byte("hello")
+	b.AddressHash[19]++
+	if err := b.verify(); err == nil {
+		t.Errorf("verify accepted a broadcast claiming to be from another address")
+	}
+}
+
+func TestPubKeyVerify(t *testing.T) {
+	id, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := id.PubKey()
+	if err := k.sign(id.SigningKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.verify(); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	k.ExtraBytes++
+	if err := k.verify(); err == nil {
+		t.Errorf("verify accepted a tampered pubkey")
+	}
+}
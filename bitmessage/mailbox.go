@@ -0,0 +1,327 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+// This file implements the delivery of messages to our own identities and of
+// broadcasts from addresses we subscribe to, and the mailing lists that
+// relay received messages as broadcasts. The mailbox is shared between the
+// main server routine and library users, so all access to it must hold its
+// lock.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type mailbox struct {
+	sync.Mutex
+	// identities are our own addresses, indexed by their ripe.
+	identities map[[20]byte]*Identity
+	inbox      []*Message
+	outbox     []*OutgoingMessage
+	// subscriptions are the addresses whose broadcasts we receive, indexed
+	// by their ripe.
+	subscriptions map[[20]byte]Address
+	// acks maps the inventory hash of the acks we are waiting for to their
+	// messages.
+	acks map[objHash]*OutgoingMessage
+	// mailingLists are the ripes of our identities that act as mailing
+	// lists, with the names that prefix the subjects of their broadcasts.
+	// See SetMailingList.
+	mailingLists map[[20]byte]string
+}
+
+// Message is a message received by one of our identities, or a broadcast
+// from one of our subscriptions.
+type Message struct {
+	From Address
+	// To is empty for broadcasts.
+	To        Address
+	Broadcast bool
+	Encoding  uint64
+	// Subject is only set for EncodingSimple.
+	Subject string
+	Body    string
+	// Received is when the message was decrypted by this node.
+	Received time.Time
+}
+
+// AddIdentity makes the node receive messages addressed to id. It can be
+// called before or after Run.
+func (n *Node) AddIdentity(id *Identity) {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	if n.mailbox.identities == nil {
+		n.mailbox.identities = make(map[[20]byte]*Identity)
+	}
+	n.mailbox.identities[id.Ripe] = id
+}
+
+// Identities returns the identities that were added to the node.
+func (n *Node) Identities() []*Identity {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	ids := make([]*Identity, 0, len(n.mailbox.identities))
+	for _, id := range n.mailbox.identities {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Inbox returns all messages received so far, oldest first.
+func (n *Node) Inbox() []*Message {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	return append([]*Message(nil), n.mailbox.inbox...)
+}
+
+// Subscribe makes the node receive the broadcasts sent by address.
+func (n *Node) Subscribe(address string) error {
+	a, err := DecodeAddress(address)
+	if err != nil {
+		return err
+	}
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	if n.mailbox.subscriptions == nil {
+		n.mailbox.subscriptions = make(map[[20]byte]Address)
+	}
+	n.mailbox.subscriptions[a.Ripe] = a
+	return nil
+}
+
+// Unsubscribe stops the delivery of broadcasts sent by address.
+func (n *Node) Unsubscribe(address string) error {
+	a, err := DecodeAddress(address)
+	if err != nil {
+		return err
+	}
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	delete(n.mailbox.subscriptions, a.Ripe)
+	return nil
+}
+
+// Subscriptions returns the addresses whose broadcasts the node receives.
+func (n *Node) Subscriptions() []Address {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	subs := make([]Address, 0, len(n.mailbox.subscriptions))
+	for _, a := range n.mailbox.subscriptions {
+		subs = append(subs, a)
+	}
+	return subs
+}
+
+// SetMailingList makes one of our identities act as a mailing list, or stops
+// it. While enabled, every message received by addr is broadcast to its
+// subscribers, with the subject prefixed by name in brackets, if set.
+func (n *Node) SetMailingList(addr Address, enabled bool, name string) error {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	if _, ok := n.mailbox.identities[addr.Ripe]; !ok {
+		return fmt.Errorf("bitmessage: %v is not one of our identities", addr)
+	}
+	if !enabled {
+		delete(n.mailbox.mailingLists, addr.Ripe)
+		return nil
+	}
+	if n.mailbox.mailingLists == nil {
+		n.mailbox.mailingLists = make(map[[20]byte]string)
+	}
+	n.mailbox.mailingLists[addr.Ripe] = name
+	return nil
+}
+
+// receiveBroadcast delivers b to the inbox if we subscribe to its sender.
+// The signature of version 1 broadcasts was verified by parseBroadcast.
+// Version 2 broadcasts are encrypted, so they are decrypted with the key of
+// each subscription until one works, which also verifies them. Version 3
+// broadcasts carry the tag of their sender, so only that subscription's key
+// is tried.
+func (n *Node) receiveBroadcast(b broadcast) {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	switch b.BroadcastVersion {
+	case 1:
+		if _, ok := n.mailbox.subscriptions[b.AddressHash]; !ok {
+			return
+		}
+	case 2:
+		found := false
+		for _, a := range n.mailbox.subscriptions {
+			if a.Stream != b.StreamNumber {
+				continue
+			}
+			err := decryptBroadcast(&b, a)
+			if err == errInvalidMAC {
+				continue
+			}
+			if err != nil {
+				log.Printf("receiveBroadcast: dropping broadcast from %v: %v", a, err)
+				return
+			}
+			found = true
+			break
+		}
+		if !found {
+			return
+		}
+	case 3:
+		found := false
+		for _, a := range n.mailbox.subscriptions {
+			if a.Version < 4 || a.tag() != b.Tag {
+				continue
+			}
+			if err := decryptBroadcast(&b, a); err != nil {
+				log.Printf("receiveBroadcast: dropping broadcast from %v: %v", a, err)
+				return
+			}
+			found = true
+			break
+		}
+		if !found {
+			return
+		}
+	default:
+		return
+	}
+	in := newMessage(b.Encoding, b.Message)
+	in.From = Address{
+		Version: b.AddressVersion,
+		Stream:  b.StreamNumber,
+		Ripe:    b.AddressHash,
+	}
+	in.Broadcast = true
+	n.mailbox.inbox = append(n.mailbox.inbox, in)
+	log.Printf("received broadcast from %v", in.From)
+}
+
+// receiveMsg tries to decrypt m with each of our identities' keys. The
+// message is delivered to the inbox if one of them succeeds. Most msgs are
+// meant for others, so failures are silent.
+func (n *Node) receiveMsg(m msg) {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	for _, id := range n.mailbox.identities {
+		plaintext, err := decrypt(id.EncryptionKey, m.Encrypted)
+		if err != nil {
+			continue
+		}
+		data, err := parseUnencryptedMessageData(plaintext)
+		if err != nil {
+			log.Printf("receiveMsg: message to %v is invalid: %v", id, err)
+			return
+		}
+		if err = data.verify(); err != nil {
+			log.Printf("receiveMsg: dropping forged message to %v: %v", id, err)
+			return
+		}
+		if data.destinationRipe != id.Ripe {
+			// Someone encrypted this to our key but addressed it to a
+			// different ripe, maybe to trick us into replying.
+			log.Printf("receiveMsg: message encrypted for %v has the wrong destination %x", id, data.destinationRipe)
+			return
+		}
+		in := newMessage(data.encoding, data.message)
+		in.From = Address{
+			Version: data.addressVersion,
+			Stream:  data.streamNumber,
+			Ripe:    pubKeysRipe(data.publicSigningKey, data.publicEncryptionKey),
+		}
+		in.To = id.Address
+		n.mailbox.inbox = append(n.mailbox.inbox, in)
+		log.Printf("received message from %v to %v", in.From, in.To)
+		if name, ok := n.mailbox.mailingLists[id.Ripe]; ok && in.From != id.Address {
+			subject, body := mailingListContent(name, in)
+			n.queueBroadcast(id.Address, in.Encoding, subject, body)
+		}
+		// Every member of a chan receives its messages, so they are never
+		// acknowledged.
+		if id.Chan == "" && data.behavior&behaviorDoesAck != 0 && len(data.ackData) > 0 {
+			n.sendAck(data.ackData)
+		}
+		return
+	}
+}
+
+// sendAck relays the ack embedded in a message we received, so its sender
+// knows it was delivered. The ack is a complete msg message, including the
+// header, prepared by the sender.
+func (n *Node) sendAck(ackData []byte) {
+	// readMessage skips garbage until it finds the magic header, so make
+	// sure it's there.
+	if !bytes.HasPrefix(ackData, magicHeaderSlice) {
+		log.Println("sendAck: ack data doesn't start with a message header")
+		return
+	}
+	m, err := readMessage(bytes.NewReader(ackData))
+	if err != nil {
+		log.Println("sendAck:", err)
+		return
+	}
+	if m.h.command != "msg" {
+		log.Printf("sendAck: ack has unexpected command %q", m.h.command)
+		return
+	}
+	payload, _ := ioutil.ReadAll(m.p)
+	// Nonce, time, stream and at least one byte of content.
+	if len(payload) < 8+4+1+1 {
+		log.Println("sendAck: ack too short")
+		return
+	}
+	ack, err := parseMsg(bytes.NewReader(payload))
+	if err != nil {
+		log.Println("sendAck:", err)
+		return
+	}
+	n.relayObject(ack.StreamNumber, "msg", payload)
+}
+
+// mailingListContent returns the subject and body of the broadcast that
+// relays in to the subscribers of the mailing list with the given name. Like
+// in PyBitmessage, the body says who sent the message, although that can't be
+// verified by the subscribers.
+func mailingListContent(name string, in *Message) (subject, body string) {
+	subject = in.Subject
+	if prefix := "[" + name + "]"; name != "" && !strings.Contains(subject, prefix) {
+		subject = prefix + " " + subject
+	}
+	body = "Message ostensibly from " + in.From.String() + ":\n\n" + in.Body
+	return subject, body
+}
+
+// newMessage decodes the message content according to its encoding.
+func newMessage(encoding uint64, content []byte) *Message {
+	m := &Message{Encoding: encoding, Received: time.Now()}
+	switch encoding {
+	case EncodingSimple:
+		// 'Subject:' + subject + '\n' + 'Body:' + message
+		content = bytes.TrimPrefix(content, []byte("Subject:"))
+		parts := bytes.SplitN(content, []byte("\nBody:"), 2)
+		m.Subject = string(parts[0])
+		if len(parts) == 2 {
+			m.Body = string(parts[1])
+		}
+	default:
+		m.Body = string(content)
+	}
+	return m
+}
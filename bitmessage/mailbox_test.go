@@ -0,0 +1,238 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSubscriptions(t *testing.T) {
+	sender, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := sender.PubKey()
+	b := broadcast{
+		BroadcastVersion:    1,
+		AddressVersion:      sender.Version,
+		StreamNumber:        sender.Stream,
+		Behavior:            pub.Behavior,
+		PublicSigningKey:    pub.PublicSigningKey,
+		PublicEncryptionKey: pub.PublicEncryptionKey,
+		NonceTrialsPerByte:  pub.NonceTrialsPerByte,
+		ExtraBytes:          pub.ExtraBytes,
+		AddressHash:         sender.Ripe,
+		Encoding:            EncodingSimple,
+		Message:             []byte("Subject:maintenance\nBody:tonight"),
+	}
+
+	n := new(Node)
+	n.receiveBroadcast(b)
+	if len(n.Inbox()) != 0 {
+		t.Fatalf("broadcast delivered without a subscription")
+	}
+	if err := n.Subscribe("BM-garbage"); err == nil {
+		t.Errorf("Subscribe accepted an invalid address")
+	}
+	if err := n.Subscribe(sender.String()); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if subs := n.Subscriptions(); len(subs) != 1 || subs[0] != sender.Address {
+		t.Errorf("wanted subscriptions [%v], got %v", sender, subs)
+	}
+	n.receiveBroadcast(b)
+	inbox := n.Inbox()
+	if len(inbox) != 1 {
+		t.Fatalf("wanted 1 message in the inbox, got %d", len(inbox))
+	}
+	if m := inbox[0]; !m.Broadcast || m.From != sender.Address || m.Subject != "maintenance" || m.Body != "tonight" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	if err := n.Unsubscribe(sender.String()); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+	n.receiveBroadcast(b)
+	if len(n.Inbox()) != 1 {
+		t.Errorf("broadcast delivered after unsubscribing")
+	}
+}
+
+func TestEncryptedBroadcast(t *testing.T) {
+	// Version 4 addresses send version 3 broadcasts, identified by a tag.
+	for _, version := range []uint64{3, 4} {
+		sender, err := NewIdentity(streamOne)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.Version = version
+		other, err := NewIdentity(streamOne)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Version = version
+		b, err := newBroadcast(sender, EncodingSimple, "maintenance", "tonight")
+		if err != nil {
+			t.Fatalf("newBroadcast: %v", err)
+		}
+		if want := version - 1; b.BroadcastVersion != want {
+			t.Errorf("version %d address sent broadcast version %d, wanted %d", version, b.BroadcastVersion, want)
+		}
+		buf := new(bytes.Buffer)
+		writeBroadcast(buf, b)
+		if got := objectTime(buf.Bytes()); !got.Equal(time.Unix(int64(b.Time), 0)) {
+			t.Errorf("objectTime got %v, wanted %v", got, time.Unix(int64(b.Time), 0))
+		}
+		// Only the fields in the clear are known when it's received.
+		received := broadcast{
+			Time:             b.Time,
+			BroadcastVersion: b.BroadcastVersion,
+			StreamNumber:     b.StreamNumber,
+			Tag:              b.Tag,
+			Encrypted:        b.Encrypted,
+		}
+
+		n := new(Node)
+		n.Subscribe(other.String())
+		n.receiveBroadcast(received)
+		if len(n.Inbox()) != 0 {
+			t.Fatalf("broadcast delivered without a subscription to its sender")
+		}
+		n.Subscribe(sender.String())
+		tampered := received
+		tampered.Time++
+		n.receiveBroadcast(tampered)
+		if len(n.Inbox()) != 0 {
+			t.Fatalf("broadcast with a tampered time was delivered")
+		}
+		n.receiveBroadcast(received)
+		inbox := n.Inbox()
+		if len(inbox) != 1 {
+			t.Fatalf("wanted 1 message in the inbox, got %d", len(inbox))
+		}
+		if m := inbox[0]; !m.Broadcast || m.From != sender.Address || m.Subject != "maintenance" || m.Body != "tonight" {
+			t.Errorf("unexpected message %+v", m)
+		}
+	}
+}
+
+func TestChans(t *testing.T) {
+	n := new(Node)
+	if _, err := n.JoinChan(""); err == nil {
+		t.Errorf("JoinChan accepted an empty name")
+	}
+	c, err := n.JoinChan("general")
+	if err != nil {
+		t.Fatalf("JoinChan: %v", err)
+	}
+	// The address of the "general" chan in the network.
+	if want := "BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r"; c.String() != want {
+		t.Errorf("wanted chan address %v, got %v", want, c)
+	}
+	if chans := n.Chans(); len(chans) != 1 || chans[0] != c {
+		t.Errorf("wanted chans [%v], got %v", c, chans)
+	}
+	if _, err := n.PostToChan("unknown", EncodingSimple, "hello", "world"); err == nil {
+		t.Errorf("PostToChan accepted a chan we didn't join")
+	}
+	if _, err := n.PostToChan("general", EncodingSimple, "hello", "world"); err != nil {
+		t.Errorf("PostToChan: %v", err)
+	}
+	if outbox := n.Outbox(); len(outbox) != 1 || outbox[0].From != c.Address || outbox[0].To != c.Address {
+		t.Errorf("post not found in the outbox: %+v", outbox)
+	}
+
+	// Anyone can post to the chan. The ack is ignored since all members
+	// receive the message.
+	member, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMsg(member, c.PubKey(), EncodingSimple, "hello", "world", []byte("ack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.receiveMsg(m)
+	inbox := n.Inbox()
+	if len(inbox) != 1 {
+		t.Fatalf("wanted 1 message in the inbox, got %d", len(inbox))
+	}
+	if in := inbox[0]; in.From != member.Address || in.To != c.Address || in.Subject != "hello" {
+		t.Errorf("unexpected message %+v", in)
+	}
+
+	if err := n.LeaveChan("general"); err != nil {
+		t.Fatalf("LeaveChan: %v", err)
+	}
+	if err := n.LeaveChan("general"); err == nil {
+		t.Errorf("LeaveChan succeeded twice")
+	}
+	n.receiveMsg(m)
+	if len(n.Inbox()) != 1 {
+		t.Errorf("message delivered after leaving the chan")
+	}
+}
+
+func TestMailingList(t *testing.T) {
+	list, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := new(Node)
+	if err := n.SetMailingList(list.Address, true, "ops"); err == nil {
+		t.Errorf("SetMailingList accepted an address that isn't one of our identities")
+	}
+	n.AddIdentity(list)
+	if err := n.SetMailingList(list.Address, true, "ops"); err != nil {
+		t.Fatalf("SetMailingList: %v", err)
+	}
+	for _, subject := range []string{"outage", "Re: [ops] outage"} {
+		m, err := newMsg(member, list.PubKey(), EncodingSimple, subject, "db is down", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.receiveMsg(m)
+	}
+	outbox := n.Outbox()
+	if len(outbox) != 2 {
+		t.Fatalf("wanted 2 broadcasts in the outbox, got %+v", outbox)
+	}
+	body := "Message ostensibly from " + member.String() + ":\n\ndb is down"
+	for i, subject := range []string{"[ops] outage", "Re: [ops] outage"} {
+		out := outbox[i]
+		if !out.Broadcast || out.From != list.Address || out.State != StateQueued {
+			t.Errorf("unexpected outgoing message %+v", out)
+		}
+		if out.Subject != subject || out.Body != body {
+			t.Errorf("wanted subject %q and body %q, got %q and %q", subject, body, out.Subject, out.Body)
+		}
+	}
+
+	n.SetMailingList(list.Address, false, "")
+	m, err := newMsg(member, list.PubKey(), EncodingSimple, "outage", "fixed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.receiveMsg(m)
+	if len(n.Outbox()) != 2 {
+		t.Errorf("message relayed after disabling the mailing list")
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"strings"
 
 	"code.google.com/p/go.crypto/ripemd160"
+	"github.com/btcsuite/btcd/btcec"
 	encVarint "github.com/nictuku/guardian/encoding/varint"
 	encVarstring "github.com/spearson78/guardian/encoding/varstring"
 )
@@ -58,7 +59,14 @@ func init() {
 // "version", "verack", "addr" and "inv".
 func writeMessage(w io.Writer, command string, payload []byte) {
 	log.Println("sending", command)
+	if _, err := w.Write(encodeMessage(command, payload)); err != nil {
+		log.Println("writeMessage write failed: ", err)
+	}
+}
 
+// encodeMessage returns the wire format of a message with the provided
+// command and payload.
+func encodeMessage(command string, payload []byte) []byte {
 	// TODO performance: pre-allocate byte slices, share between instances.
 	buf := new(bytes.Buffer)
 
@@ -74,10 +82,7 @@ func writeMessage(w io.Writer, command string, payload []byte) {
 	putUint32(buf, sha512HashPrefix(payload))
 	// The actual data, a message or an object
 	putBytes(buf, payload)
-
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		log.Println("writeMessage write failed: ", err)
-	}
+	return buf.Bytes()
 }
 
 type parserState struct {
@@ -127,6 +132,11 @@ func readMessage(r io.Reader) (*message, error) {
 		// deadline set, so it shouldn't be a problem.
 
 		n, err = io.ReadAtLeast(r, buf, 20)
+		if err != nil {
+			// Also the case when the deadline passes, or the connection
+			// is closed.
+			return nil, fmt.Errorf("readMessage: error seeking the message start: %w", err)
+		}
 		for p.pos = 0; p.pos < n && p.magicPos != 4; p.pos++ {
 			if buf[p.pos] == magicHeaderSlice[p.magicPos] {
 				p.magicPos += 1
@@ -148,7 +158,7 @@ func readMessage(r io.Reader) (*message, error) {
 		return nil, fmt.Errorf("readMessage: error reading header: %v", err.Error())
 	}
 	if header, err = parseHeaderFields(data); err != nil {
-		return nil, fmt.Errorf("readMessage: %v", err.Error())
+		return nil, fmt.Errorf("readMessage: %w", err)
 	}
 	// TODO performance: depending on the command type, pipe directly do disk
 	// instead of keeping all in memory?
@@ -166,7 +176,7 @@ func readMessage(r io.Reader) (*message, error) {
 		return nil, fmt.Errorf("readMessage: stream ended before we could get the payload data, wanted length %d, got %d", header.payloadLength, data.Len())
 	}
 	if checksum := sha512HashPrefix(data.Bytes()); header.checksum != checksum {
-		return nil, fmt.Errorf("readMessage: checksum mismatch: message advertised %x, calculated %x", header.checksum, checksum)
+		return nil, misbehaving(banScoreBadChecksum, fmt.Errorf("readMessage: checksum mismatch: message advertised %x, calculated %x", header.checksum, checksum))
 	}
 	return &message{h: header, p: data}, nil
 }
@@ -177,7 +187,7 @@ func parseHeaderFields(data io.Reader) (m messageHeader, err error) {
 	}
 	m.payloadLength = int(readUint32(data))
 	if m.payloadLength > maxPayloadLength {
-		return m, fmt.Errorf("headerFields: advertised payload length too large, aborting.")
+		return m, misbehaving(banScoreOversizePayload, fmt.Errorf("headerFields: advertised payload length too large, aborting."))
 	}
 	m.checksum = readUint32(data)
 	return m, nil
@@ -226,7 +236,9 @@ type NetworkAddress struct {
 
 func (addr NetworkAddress) ipPort() ipPort {
 	ip := parseIP(addr.IP)
-	return ipPort(fmt.Sprintf("%v:%d", ip.String(), addr.Port))
+	// JoinHostPort adds brackets to IPv6 addresses, to match the ipPorts of
+	// connections.
+	return ipPort(net.JoinHostPort(ip.String(), fmt.Sprint(addr.Port)))
 }
 
 type extendedNetworkAddress struct {
@@ -253,6 +265,14 @@ type inventoryVector struct {
 	Hash [32]byte
 }
 
+// inventoryHash calculates the hash that identifies an object in inventory
+// vectors, given its payload.
+func inventoryHash(payload []byte) (h objHash) {
+	d, _ := doubleHash(payload)
+	copy(h[:], d)
+	return h
+}
+
 func writeInventoryVector(w io.Writer, invs []inventoryVector) (err error) {
 	if len(invs) > maxInventoryEntries {
 		return fmt.Errorf("Asked to write %d inventory vectors for getdata, but the maximum is %d. Ignoring.", len(invs), maxInventoryEntries)
@@ -271,6 +291,9 @@ func parseInv(r io.Reader) ([]inventoryVector, error) {
 	if err != nil {
 		return nil, err
 	}
+	if count > maxInventoryEntries {
+		return nil, fmt.Errorf("parseInv: %d entries exceed the maximum of %d", count, maxInventoryEntries)
+	}
 	ivs := make([]inventoryVector, count)
 	err = binary.Read(r, binary.BigEndian, ivs)
 	return ivs, err
@@ -281,15 +304,16 @@ func parseInv(r io.Reader) ([]inventoryVector, error) {
 type varint []byte
 type varstring []byte
 
+// UnencryptedMessageData is the content of a msg object after decryption.
 type UnencryptedMessageData struct {
 	// Message format version.
-	msgVersion varint
+	msgVersion uint64
 	// Sender's address version number. This is needed in order to calculate
 	// the sender's address to show in the UI, and also to allow for forwards
 	// compatible changes to the public-key data included below.
-	addressVersion varint
+	addressVersion uint64
 	// Sender's stream number.
-	streamNumber varint
+	streamNumber uint64
 	// A bitfield of optional behaviors and features that can be expected from
 	// the node with this pubkey included in this msg message (the sender's
 	// pubkey).
@@ -300,25 +324,114 @@ type UnencryptedMessageData struct {
 	// The ECC public key used for encryption (uncompressed format; normally
 	// prepended with \x04 ).
 	publicEncryptionKey [64]byte
+	// Proof of work difficulty demanded by the sender. Only present for
+	// address versions 3 and above.
+	nonceTrialsPerByte uint64
+	extraBytes         uint64
 	// The ripe hash of the public key of the receiver of the message.
 	destinationRipe [20]byte
 	// Message encoding type.
-	encoding varint
+	encoding uint64
 	// Message length.
-	messageLength varint
+	messageLength uint64
 	// The message.
 	message []byte
 	// Length of the acknowledgement data
-	ackLength varint
+	ackLength uint64
 	// The acknowledgement data to be transmitted. This takes the form of a
 	// Bitmessage protocol message, like another msg message. The POW therein
 	// must already be completed.
 	ackData []byte
 	// Length of the signature.
-	sigLength varint
+	sigLength uint64
 	// The ECDSA signature which covers everything from the msg_version to the
 	// ack_data.
-	singnature []byte
+	signature []byte
+}
+
+func parseUnencryptedMessageData(b []byte) (d UnencryptedMessageData, err error) {
+	r := bytes.NewReader(b)
+	if d.msgVersion, _, err = encVarint.ReadVarInt(r); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading msg version: %v", err)
+	}
+	if d.msgVersion != 1 {
+		return d, fmt.Errorf("parseUnencryptedMessageData: unsupported msg version %d", d.msgVersion)
+	}
+	if d.addressVersion, _, err = encVarint.ReadVarInt(r); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading address version: %v", err)
+	}
+	if d.streamNumber, _, err = encVarint.ReadVarInt(r); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading stream number: %v", err)
+	}
+	if err = binary.Read(r, binary.BigEndian, &d.behavior); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading behavior: %v", err)
+	}
+	if err = binary.Read(r, binary.BigEndian, &d.publicSigningKey); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading signing key: %v", err)
+	}
+	if err = binary.Read(r, binary.BigEndian, &d.publicEncryptionKey); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading encryption key: %v", err)
+	}
+	if d.addressVersion >= 3 {
+		if d.nonceTrialsPerByte, _, err = encVarint.ReadVarInt(r); err != nil {
+			return d, fmt.Errorf("parseUnencryptedMessageData reading nonce trials per byte: %v", err)
+		}
+		if d.extraBytes, _, err = encVarint.ReadVarInt(r); err != nil {
+			return d, fmt.Errorf("parseUnencryptedMessageData reading extra bytes: %v", err)
+		}
+	}
+	if err = binary.Read(r, binary.BigEndian, &d.destinationRipe); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading destination ripe: %v", err)
+	}
+	if d.encoding, _, err = encVarint.ReadVarInt(r); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading encoding: %v", err)
+	}
+	if d.messageLength, d.message, err = readVarBytes(r); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading message: %v", err)
+	}
+	if d.ackLength, d.ackData, err = readVarBytes(r); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading ack data: %v", err)
+	}
+	if d.sigLength, d.signature, err = readVarBytes(r); err != nil {
+		return d, fmt.Errorf("parseUnencryptedMessageData reading signature: %v", err)
+	}
+	return d, nil
+}
+
+// signedData returns the encoded fields covered by the signature, from the
+// msg version to the ack data.
+func (d *UnencryptedMessageData) signedData() []byte {
+	buf := new(bytes.Buffer)
+	encVarint.WriteVarInt(buf, d.msgVersion)
+	encVarint.WriteVarInt(buf, d.addressVersion)
+	encVarint.WriteVarInt(buf, d.streamNumber)
+	putUint32(buf, d.behavior)
+	putBytes(buf, d.publicSigningKey[:])
+	putBytes(buf, d.publicEncryptionKey[:])
+	if d.addressVersion >= 3 {
+		encVarint.WriteVarInt(buf, d.nonceTrialsPerByte)
+		encVarint.WriteVarInt(buf, d.extraBytes)
+	}
+	putBytes(buf, d.destinationRipe[:])
+	encVarint.WriteVarInt(buf, d.encoding)
+	encVarint.WriteVarInt(buf, uint64(len(d.message)))
+	putBytes(buf, d.message)
+	encVarint.WriteVarInt(buf, uint64(len(d.ackData)))
+	putBytes(buf, d.ackData)
+	return buf.Bytes()
+}
+
+// verify checks that the message was signed by the sender.
+func (d *UnencryptedMessageData) verify() error {
+	return verify(d.publicSigningKey, d.signedData(), d.signature)
+}
+
+func writeUnencryptedMessageData(w io.Writer, d *UnencryptedMessageData) error {
+	buf := bytes.NewBuffer(d.signedData())
+	encVarint.WriteVarInt(buf, uint64(len(d.signature)))
+	putBytes(buf, d.signature)
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 const (
@@ -343,6 +456,10 @@ const (
 	// If true, the receiving node does send acknowledgements (rather than
 	// dropping them). Note that this is the least significant bit.
 	pubKeyDoesAck = 31
+
+	// behaviorDoesAck is the mask of pubKeyDoesAck in the bitfield, whose
+	// bits are numbered from the most significant one.
+	behaviorDoesAck uint32 = 1 << (31 - pubKeyDoesAck)
 )
 
 // binaryVersionMessage is the initial section of a Version message that can be
@@ -395,29 +512,314 @@ func parseVersion(r io.Reader) (versionMessage, error) {
 // not older than 2 days. To create an object, the Proof Of Work has to be
 // done.
 
+// readTime reads the time of an object. It used to be 4 bytes long, and is
+// 8 bytes long in the objects of version 4 addresses. Those are told apart
+// because the first 4 bytes of an 8 byte time are zero for the next decades.
+func readTime(r io.Reader) (uint64, error) {
+	var t uint32
+	if err := binary.Read(r, binary.BigEndian, &t); err != nil {
+		return 0, err
+	}
+	if t != 0 {
+		return uint64(t), nil
+	}
+	err := binary.Read(r, binary.BigEndian, &t)
+	return uint64(t), err
+}
+
+// putTime writes the time of an object, in 8 bytes for the objects of
+// version 4 addresses and in 4 bytes for the others. See readTime.
+func putTime(w io.Writer, t uint64, addressVersion uint64) {
+	if addressVersion >= 4 {
+		putUint64(w, t)
+	} else {
+		putUint32(w, uint32(t)) // XXX moving to uint64 soon.
+	}
+}
+
 // When a node has the hash of a public key (from an address) but not the
 // public key itself, it must send out a request for the public key.
 type GetPubKey struct {
-	powNonce       uint64   // Random nonce used for the Proof Of Work
-	time           uint64   // The time that this message was generated and broadcast.
-	addressVersion varint   // The address' version.
-	streamNumber   varint   // The address' stream number
-	pubKeyHash     [20]byte // The ripemd hash of the public key
+	PowNonce       [8]byte  // Random nonce used for the Proof Of Work
+	Time           uint64   // The time that this message was generated and broadcast.
+	AddressVersion uint64   // The address' version.
+	StreamNumber   uint64   // The address' stream number
+	PubKeyHash     [20]byte // The ripemd hash of the public key
+	// Version 4 addresses are requested by their tag instead of the hash,
+	// so nodes that don't know the address can't tell whose key it is.
+	Tag [32]byte
+}
+
+func writeGetPubKey(w io.Writer, g GetPubKey) error {
+	buf := new(bytes.Buffer)
+	putBytes(buf, g.PowNonce[:])
+	putTime(buf, g.Time, g.AddressVersion)
+	encVarint.WriteVarInt(buf, g.AddressVersion)
+	encVarint.WriteVarInt(buf, g.StreamNumber)
+	if g.AddressVersion >= 4 {
+		putBytes(buf, g.Tag[:])
+	} else {
+		putBytes(buf, g.PubKeyHash[:])
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func parseGetPubKey(r io.Reader) (g GetPubKey, err error) {
+	if _, err = io.ReadFull(r, g.PowNonce[:]); err != nil {
+		return g, fmt.Errorf("parseGetPubKey reading nonce: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, r); err != nil {
+		return g, err
+	}
+	if err := checkProofOfWork(buf.Bytes(), g.PowNonce); err != nil {
+		return g, err
+	}
+	if g.Time, err = readTime(buf); err != nil {
+		return g, fmt.Errorf("parseGetPubKey reading time: %v", err)
+	}
+	if g.AddressVersion, _, err = encVarint.ReadVarInt(buf); err != nil {
+		return g, fmt.Errorf("parseGetPubKey reading address version: %v", err)
+	}
+	if g.StreamNumber, _, err = encVarint.ReadVarInt(buf); err != nil {
+		return g, fmt.Errorf("parseGetPubKey reading stream number: %v", err)
+	}
+	if g.AddressVersion >= 4 {
+		if err = binary.Read(buf, binary.BigEndian, &g.Tag); err != nil {
+			return g, fmt.Errorf("parseGetPubKey reading tag: %v", err)
+		}
+		return g, nil
+	}
+	if err = binary.Read(buf, binary.BigEndian, &g.PubKeyHash); err != nil {
+		return g, fmt.Errorf("parseGetPubKey reading pubkey hash: %v", err)
+	}
+	return g, nil
 }
 
 // A public key.
 type PubKey struct {
-	powNonce       uint64 // Random nonce used for the Proof Of Work
-	time           uint64 // The time that this message was generated and broadcast.
-	addressVersion varint // The address' version.
-	streamNumber   varint // The address' stream number
-	behavior       uint32 // A bitfield of optional behaviors and features that can be expected from the node receiving the message.
+	PowNonce       [8]byte // Random nonce used for the Proof Of Work
+	Time           uint64  // The time that this message was generated and broadcast.
+	AddressVersion uint64  // The address' version.
+	StreamNumber   uint64  // The address' stream number
+	Behavior       uint32  // A bitfield of optional behaviors and features that can be expected from the node receiving the message.
 	// The ECC public key used for signing (uncompressed format; normally
 	// prepended with \x04).
-	publicSigningKey [64]byte
+	PublicSigningKey [64]byte
 	// The ECC public key used for encryption (uncompressed format; normally
 	// prepended with \x04 ).
-	publicEncryptionKey [64]byte
+	PublicEncryptionKey [64]byte
+	// Proof of work difficulty demanded by the owner of this key. Only
+	// present for address versions 3 and above.
+	NonceTrialsPerByte uint64
+	ExtraBytes         uint64
+	// The ECDSA signature which covers everything from the time to the extra
+	// bytes. Only present for address versions 3 and above.
+	Signature []byte
+	// Tag identifies the address of version 4 pubkeys, whose fields after
+	// the tag are encrypted so only those who know the address can read
+	// them. The signature also covers the tag. See addressKeys.
+	Tag [32]byte
+	// Encrypted holds the fields after the tag in version 4 pubkeys. Those
+	// fields are only set after decryptPubKey.
+	Encrypted []byte
+}
+
+// Address returns the address that owns this public key.
+func (k *PubKey) Address() Address {
+	return Address{
+		Version: k.AddressVersion,
+		Stream:  k.StreamNumber,
+		Ripe:    pubKeysRipe(k.PublicSigningKey, k.PublicEncryptionKey),
+	}
+}
+
+// tag returns the tag of the address that owns k. It's in the clear in
+// version 4 pubkeys, and calculated for the others.
+func (k *PubKey) tag() [32]byte {
+	if k.AddressVersion >= 4 {
+		return k.Tag
+	}
+	return k.Address().tag()
+}
+
+// decrypted returns whether the fields of k are known, which is the case for
+// version 4 pubkeys once decryptPubKey verified their signature.
+func (k *PubKey) decrypted() bool {
+	return k.AddressVersion < 4 || k.Signature != nil
+}
+
+func writePubKey(w io.Writer, k PubKey) error {
+	buf := new(bytes.Buffer)
+	putBytes(buf, k.PowNonce[:])
+	putTime(buf, k.Time, k.AddressVersion)
+	encVarint.WriteVarInt(buf, k.AddressVersion)
+	encVarint.WriteVarInt(buf, k.StreamNumber)
+	if k.AddressVersion >= 4 {
+		putBytes(buf, k.Tag[:])
+		putBytes(buf, k.Encrypted)
+	} else {
+		writePubKeyContent(buf, &k)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writePubKeyContent writes the fields from the behavior to the signature,
+// which are encrypted in version 4 pubkeys.
+func writePubKeyContent(w io.Writer, k *PubKey) {
+	putUint32(w, k.Behavior)
+	putBytes(w, k.PublicSigningKey[:])
+	putBytes(w, k.PublicEncryptionKey[:])
+	if k.AddressVersion >= 3 {
+		encVarint.WriteVarInt(w, k.NonceTrialsPerByte)
+		encVarint.WriteVarInt(w, k.ExtraBytes)
+		encVarint.WriteVarInt(w, uint64(len(k.Signature)))
+		putBytes(w, k.Signature)
+	}
+}
+
+func parsePubKey(r io.Reader) (k PubKey, err error) {
+	if _, err = io.ReadFull(r, k.PowNonce[:]); err != nil {
+		return k, fmt.Errorf("parsePubKey reading nonce: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, r); err != nil {
+		return k, err
+	}
+	if err := checkProofOfWork(buf.Bytes(), k.PowNonce); err != nil {
+		return k, err
+	}
+	if k.Time, err = readTime(buf); err != nil {
+		return k, fmt.Errorf("parsePubKey reading time: %v", err)
+	}
+	if k.AddressVersion, _, err = encVarint.ReadVarInt(buf); err != nil {
+		return k, fmt.Errorf("parsePubKey reading address version: %v", err)
+	}
+	if k.AddressVersion < 2 || k.AddressVersion > 4 {
+		return k, fmt.Errorf("parsePubKey: unsupported address version %d", k.AddressVersion)
+	}
+	if k.StreamNumber, _, err = encVarint.ReadVarInt(buf); err != nil {
+		return k, fmt.Errorf("parsePubKey reading stream number: %v", err)
+	}
+	if k.AddressVersion >= 4 {
+		// The rest can only be read and verified by those who know the
+		// address. See decryptPubKey.
+		if err = binary.Read(buf, binary.BigEndian, &k.Tag); err != nil {
+			return k, fmt.Errorf("parsePubKey reading tag: %v", err)
+		}
+		if buf.Len() == 0 {
+			return k, fmt.Errorf("parsePubKey Encrypted content empty")
+		}
+		k.Encrypted = buf.Bytes()
+		return k, nil
+	}
+	if err = parsePubKeyContent(bytes.NewReader(buf.Bytes()), &k); err != nil {
+		return k, err
+	}
+	if err = k.verify(); err != nil {
+		return k, fmt.Errorf("parsePubKey: %v", err)
+	}
+	return k, nil
+}
+
+// parsePubKeyContent reads the fields from the behavior to the signature,
+// which are encrypted in version 4 pubkeys.
+func parsePubKeyContent(r *bytes.Reader, k *PubKey) (err error) {
+	if err = binary.Read(r, binary.BigEndian, &k.Behavior); err != nil {
+		return fmt.Errorf("parsePubKey reading behavior: %v", err)
+	}
+	if err = binary.Read(r, binary.BigEndian, &k.PublicSigningKey); err != nil {
+		return fmt.Errorf("parsePubKey reading signing key: %v", err)
+	}
+	if err = binary.Read(r, binary.BigEndian, &k.PublicEncryptionKey); err != nil {
+		return fmt.Errorf("parsePubKey reading encryption key: %v", err)
+	}
+	if k.AddressVersion >= 3 {
+		if k.NonceTrialsPerByte, _, err = encVarint.ReadVarInt(r); err != nil {
+			return fmt.Errorf("parsePubKey reading nonce trials per byte: %v", err)
+		}
+		if k.ExtraBytes, _, err = encVarint.ReadVarInt(r); err != nil {
+			return fmt.Errorf("parsePubKey reading extra bytes: %v", err)
+		}
+		if _, k.Signature, err = readVarBytes(r); err != nil {
+			return fmt.Errorf("parsePubKey reading signature: %v", err)
+		}
+	}
+	return nil
+}
+
+// signedData returns the encoded fields covered by the signature, from the
+// time to the extra bytes.
+func (k *PubKey) signedData() []byte {
+	buf := new(bytes.Buffer)
+	putTime(buf, k.Time, k.AddressVersion)
+	encVarint.WriteVarInt(buf, k.AddressVersion)
+	encVarint.WriteVarInt(buf, k.StreamNumber)
+	if k.AddressVersion >= 4 {
+		putBytes(buf, k.Tag[:])
+	}
+	putUint32(buf, k.Behavior)
+	putBytes(buf, k.PublicSigningKey[:])
+	putBytes(buf, k.PublicEncryptionKey[:])
+	encVarint.WriteVarInt(buf, k.NonceTrialsPerByte)
+	encVarint.WriteVarInt(buf, k.ExtraBytes)
+	return buf.Bytes()
+}
+
+// sign sets the signature of k, which must be made with the private signing
+// key of its owner. Only version 3 and above pubkeys are signed.
+func (k *PubKey) sign(signingKey *btcec.PrivateKey) (err error) {
+	if k.AddressVersion < 3 {
+		return nil
+	}
+	k.Signature, err = sign(signingKey, k.signedData())
+	return err
+}
+
+// verify checks the signature of k. Pubkeys older than version 3 are not
+// signed.
+func (k *PubKey) verify() error {
+	if k.AddressVersion < 3 {
+		return nil
+	}
+	return verify(k.PublicSigningKey, k.signedData(), k.Signature)
+}
+
+// encryptPubKey encrypts the content of a version 4 pubkey of the address a,
+// filling k.Encrypted. It must already be signed.
+func encryptPubKey(k *PubKey, a Address) (err error) {
+	buf := new(bytes.Buffer)
+	writePubKeyContent(buf, k)
+	key, _ := addressKeys(a)
+	k.Encrypted, err = encrypt(key.PubKey(), buf.Bytes())
+	return err
+}
+
+// decryptPubKey decrypts a version 4 pubkey of the address a. If it succeeds,
+// the content fields of k are filled and the signature is verified.
+func decryptPubKey(k *PubKey, a Address) error {
+	key, tag := addressKeys(a)
+	if k.AddressVersion != a.Version || k.StreamNumber != a.Stream || k.Tag != tag {
+		return fmt.Errorf("decryptPubKey: pubkey isn't from %v", a)
+	}
+	plaintext, err := decrypt(key, k.Encrypted)
+	if err != nil {
+		return err
+	}
+	d := *k
+	if err = parsePubKeyContent(bytes.NewReader(plaintext), &d); err != nil {
+		return err
+	}
+	if ripe := d.Address().Ripe; ripe != a.Ripe {
+		return fmt.Errorf("decryptPubKey: keys hash to %x, not to the ripe of %v", ripe, a)
+	}
+	if err = d.verify(); err != nil {
+		return fmt.Errorf("decryptPubKey: %v", err)
+	}
+	*k = d
+	return nil
 }
 
 // Used for person-to-person messages.
@@ -442,7 +844,9 @@ func writeMsg(w io.Writer, m msg) error {
 }
 
 func parseMsg(r io.Reader) (m msg, err error) {
-	m.PowNonce = readBytes8(r)
+	if _, err = io.ReadFull(r, m.PowNonce[:]); err != nil {
+		return m, fmt.Errorf("parseMsg reading nonce: %v", err)
+	}
 	// TODO:
 	buf := new(bytes.Buffer)
 	if _, err := io.Copy(buf, r); err != nil {
@@ -453,7 +857,11 @@ func parseMsg(r io.Reader) (m msg, err error) {
 		return m, err
 	}
 	// TODO: Soon moving to uint32 in the wire.
-	m.Time = uint64(readUint32(r))
+	var t uint32
+	if err = binary.Read(r, binary.BigEndian, &t); err != nil {
+		return m, fmt.Errorf("parseMsg reading time: %v", err)
+	}
+	m.Time = uint64(t)
 	m.StreamNumber, _, err = encVarint.ReadVarInt(r)
 	if err != nil {
 		return m, fmt.Errorf("parseMsg reading Stream Number: %v\n", err)
@@ -468,6 +876,10 @@ func parseMsg(r io.Reader) (m msg, err error) {
 	return m, nil
 }
 
+// Broadcasts are messages from one address to everyone that subscribes to it.
+// In version 1, everything is in the clear. In version 2, everything after the
+// stream number is encrypted with a key derived from the sender's address, so
+// only those who know the address can read it. See broadcastKey.
 type broadcast struct {
 	// Random nonce used for the Proof Of Work
 	PowNonce [8]byte
@@ -492,9 +904,15 @@ type broadcast struct {
 	// The ECC public key used for encryption (uncompressed format; normally
 	// prepended with \x04 ).
 	PublicEncryptionKey [64]byte
+	// Proof of work difficulty demanded by the sender. Only present for
+	// address versions 3 and above.
+	NonceTrialsPerByte uint64
+	ExtraBytes         uint64
 	// The sender's address hash. This is included so that nodes can more
 	// cheaply detect whether this is a broadcast message for which they are
 	// listening, although it must be verified with the public key above.
+	// Version 2 broadcasts don't include it, the hash is known from the key
+	// that decrypted the broadcast.
 	AddressHash [20]byte
 	// Message encoding type.
 	Encoding uint64
@@ -504,71 +922,246 @@ type broadcast struct {
 	Message []byte
 	// Length of the signature.
 	SigLength uint64
-	// The ECDSA signature which covers everything from the msg_version to the
-	// ack_data.
+	// The ECDSA signature which covers everything from the broadcast version
+	// to the message. Since version 2, it also covers the time, the stream
+	// number and the tag that precede the encrypted data.
 	Signature []byte
+	// Tag identifies the sender of version 3 broadcasts, which are sent by
+	// version 4 addresses. See addressKeys.
+	Tag [32]byte
+	// Encrypted holds all fields after the StreamNumber (or the Tag) in
+	// version 2 and 3 broadcasts. Those fields are only set after
+	// decryptBroadcast.
+	Encrypted []byte
 }
 
 func parseBroadcast(r io.Reader) (b broadcast, err error) {
-	b.PowNonce = readBytes8(r)
+	if _, err = io.ReadFull(r, b.PowNonce[:]); err != nil {
+		return b, fmt.Errorf("parseBroadcast reading nonce: %v", err)
+	}
 	buf := new(bytes.Buffer)
 	if _, err := io.Copy(buf, r); err != nil {
 		return b, err
 	}
-	r = buf
 	if err := checkProofOfWork(buf.Bytes(), b.PowNonce); err != nil {
 		return b, err
 	}
-	// TODO: Soon moving to uint32 in the wire.
-	b.Time = uint64(readUint32(r))
-	b.BroadcastVersion, _, err = encVarint.ReadVarInt(r)
+	content := bytes.NewReader(buf.Bytes())
+	if b.Time, err = readTime(content); err != nil {
+		return b, fmt.Errorf("parseBroadcast reading time: %v\n", err)
+	}
+	b.BroadcastVersion, _, err = encVarint.ReadVarInt(content)
 	if err != nil {
 		return b, fmt.Errorf("parseBroadcast reading broadcast version: %v\n", err)
 	}
-	if b.BroadcastVersion != 1 {
+	switch b.BroadcastVersion {
+	case 1:
+		if err = parseBroadcastContent(content, &b); err != nil {
+			return b, err
+		}
+		if err = b.verify(); err != nil {
+			return b, fmt.Errorf("parseBroadcast: %v", err)
+		}
+	case 2, 3:
+		if b.StreamNumber, _, err = encVarint.ReadVarInt(content); err != nil {
+			return b, fmt.Errorf("parseBroadcast reading Stream Number: %v\n", err)
+		}
+		if b.BroadcastVersion == 3 {
+			if _, err = io.ReadFull(content, b.Tag[:]); err != nil {
+				return b, fmt.Errorf("parseBroadcast reading tag: %v\n", err)
+			}
+		}
+		b.Encrypted = make([]byte, content.Len())
+		content.Read(b.Encrypted)
+		if len(b.Encrypted) == 0 {
+			return b, fmt.Errorf("parseBroadcast Encrypted content empty")
+		}
+	default:
 		return b, fmt.Errorf("I do not yet support Broadcasts of version %d", b.BroadcastVersion)
 	}
+	return b, nil
+}
+
+// parseBroadcastContent reads the fields from the address version to the
+// signature, which are encrypted in version 2 and 3 broadcasts.
+func parseBroadcastContent(r *bytes.Reader, b *broadcast) (err error) {
 	b.AddressVersion, _, err = encVarint.ReadVarInt(r)
 	if err != nil {
-		return b, fmt.Errorf("parseBroadcast reading address version: %v\n", err)
+		return fmt.Errorf("parseBroadcast reading address version: %v\n", err)
 	}
 	b.StreamNumber, _, err = encVarint.ReadVarInt(r)
 	if err != nil {
-		return b, fmt.Errorf("parseBroadcast reading Stream Number: %v\n", err)
+		return fmt.Errorf("parseBroadcast reading Stream Number: %v\n", err)
 	}
-	b.Behavior = readUint32(r)
-	if b.Behavior != 1 {
+	if err = binary.Read(r, binary.BigEndian, &b.Behavior); err != nil {
+		return fmt.Errorf("parseBroadcast reading behavior: %v\n", err)
+	}
+	if b.Behavior&^behaviorDoesAck != 0 {
 		log.Printf("warning: parseBroadcast unknown behavior mask: %x\n", b.Behavior)
 	}
 	if err = binary.Read(r, binary.BigEndian, &b.PublicSigningKey); err != nil {
-		return b, fmt.Errorf("parseBroadcast PublicSigningKey err: %v\n", err)
+		return fmt.Errorf("parseBroadcast PublicSigningKey err: %v\n", err)
 	}
 	if err = binary.Read(r, binary.BigEndian, &b.PublicEncryptionKey); err != nil {
-		return b, fmt.Errorf("parseBroadcast PublicEncryptionKey err: %v\n", err)
+		return fmt.Errorf("parseBroadcast PublicEncryptionKey err: %v\n", err)
 	}
-	if err = binary.Read(r, binary.BigEndian, &b.AddressHash); err != nil {
-		return b, fmt.Errorf("parseBroadcast AddressHash err: %v\n", err)
+	if b.AddressVersion >= 3 {
+		if b.NonceTrialsPerByte, _, err = encVarint.ReadVarInt(r); err != nil {
+			return fmt.Errorf("parseBroadcast reading nonce trials per byte: %v\n", err)
+		}
+		if b.ExtraBytes, _, err = encVarint.ReadVarInt(r); err != nil {
+			return fmt.Errorf("parseBroadcast reading extra bytes: %v\n", err)
+		}
+	}
+	if b.BroadcastVersion == 1 {
+		if err = binary.Read(r, binary.BigEndian, &b.AddressHash); err != nil {
+			return fmt.Errorf("parseBroadcast AddressHash err: %v\n", err)
+		}
 	}
 	// PyBitMessage just writes '\x02'.
 	b.Encoding, _, err = encVarint.ReadVarInt(r)
 	if err != nil {
-		return b, fmt.Errorf("parseBroadcast reading encoding: %v\n", err)
+		return fmt.Errorf("parseBroadcast reading encoding: %v\n", err)
 	}
-	if b.MessageLength, _, err = encVarint.ReadVarInt(r); err != nil {
-		return b, fmt.Errorf("parseBroadcast reading message length: %v\n", err)
+	if b.MessageLength, b.Message, err = readVarBytes(r); err != nil {
+		return fmt.Errorf("parseBroadcast reading message: %v\n", err)
 	}
-	b.Message = make([]byte, b.MessageLength)
-	if _, err = r.Read(b.Message); err != nil {
-		return b, fmt.Errorf("parseBroadcast reading message: %v\n", err)
+	if b.SigLength, b.Signature, err = readVarBytes(r); err != nil {
+		return fmt.Errorf("parseBroadcast reading signature: %v\n", err)
 	}
-	if b.SigLength, _, err = encVarint.ReadVarInt(r); err != nil {
-		return b, fmt.Errorf("parseBroadcast reading siglength: %v\n", err)
+	return nil
+}
+
+func writeBroadcast(w io.Writer, b broadcast) error {
+	buf := new(bytes.Buffer)
+	putBytes(buf, b.PowNonce[:])
+	b.putTime(buf)
+	encVarint.WriteVarInt(buf, b.BroadcastVersion)
+	if b.BroadcastVersion >= 2 {
+		encVarint.WriteVarInt(buf, b.StreamNumber)
+		if b.BroadcastVersion >= 3 {
+			putBytes(buf, b.Tag[:])
+		}
+		putBytes(buf, b.Encrypted)
+	} else {
+		writeBroadcastContent(buf, &b)
+		encVarint.WriteVarInt(buf, uint64(len(b.Signature)))
+		putBytes(buf, b.Signature)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// putTime writes the time of b. Version 3 broadcasts come from version 4
+// addresses, so their time takes 8 bytes. See readTime.
+func (b *broadcast) putTime(w io.Writer) {
+	if b.BroadcastVersion >= 3 {
+		putUint64(w, b.Time)
+	} else {
+		putUint32(w, uint32(b.Time)) // XXX moving to uint64 soon.
 	}
-	b.Signature = make([]byte, b.SigLength)
-	if _, err = r.Read(b.Message); err != nil {
-		return b, fmt.Errorf("parseBroadcast reading signature: %v\n", err)
+}
+
+// writeBroadcastContent writes the fields from the address version to the
+// message.
+func writeBroadcastContent(w io.Writer, b *broadcast) {
+	encVarint.WriteVarInt(w, b.AddressVersion)
+	encVarint.WriteVarInt(w, b.StreamNumber)
+	putUint32(w, b.Behavior)
+	putBytes(w, b.PublicSigningKey[:])
+	putBytes(w, b.PublicEncryptionKey[:])
+	if b.AddressVersion >= 3 {
+		encVarint.WriteVarInt(w, b.NonceTrialsPerByte)
+		encVarint.WriteVarInt(w, b.ExtraBytes)
 	}
-	return b, nil
+	if b.BroadcastVersion == 1 {
+		putBytes(w, b.AddressHash[:])
+	}
+	encVarint.WriteVarInt(w, b.Encoding)
+	encVarint.WriteVarInt(w, uint64(len(b.Message)))
+	putBytes(w, b.Message)
+}
+
+// signedData returns the encoded fields covered by the signature. PyBitmessage
+// always uses the shortest varint encoding, so the result matches what was
+// received.
+func (b *broadcast) signedData() []byte {
+	buf := new(bytes.Buffer)
+	if b.BroadcastVersion >= 2 {
+		b.putTime(buf)
+		encVarint.WriteVarInt(buf, b.BroadcastVersion)
+		encVarint.WriteVarInt(buf, b.StreamNumber)
+		if b.BroadcastVersion >= 3 {
+			putBytes(buf, b.Tag[:])
+		}
+	} else {
+		encVarint.WriteVarInt(buf, b.BroadcastVersion)
+	}
+	writeBroadcastContent(buf, b)
+	return buf.Bytes()
+}
+
+// verify checks that the broadcast was signed by the owner of AddressHash.
+func (b *broadcast) verify() error {
+	if ripe := pubKeysRipe(b.PublicSigningKey, b.PublicEncryptionKey); ripe != b.AddressHash {
+		return fmt.Errorf("broadcast keys hash to %x, not to the claimed address hash %x", ripe, b.AddressHash)
+	}
+	return verify(b.PublicSigningKey, b.signedData(), b.Signature)
+}
+
+// broadcastKeys returns the key that encrypts the broadcasts of a, and the
+// tag that identifies them. Version 4 addresses send version 3 broadcasts,
+// which use the same key as their pubkeys.
+func broadcastKeys(a Address) (*btcec.PrivateKey, [32]byte) {
+	if a.Version >= 4 {
+		return addressKeys(a)
+	}
+	return broadcastKey(a), [32]byte{}
+}
+
+// encryptBroadcast encrypts the content of a version 2 or 3 broadcast from
+// the address a, filling b.Encrypted. It must already be signed.
+func encryptBroadcast(b *broadcast, a Address) (err error) {
+	buf := new(bytes.Buffer)
+	writeBroadcastContent(buf, b)
+	encVarint.WriteVarInt(buf, uint64(len(b.Signature)))
+	putBytes(buf, b.Signature)
+	key, _ := broadcastKeys(a)
+	b.Encrypted, err = encrypt(key.PubKey(), buf.Bytes())
+	return err
+}
+
+// decryptBroadcast tries to decrypt a version 2 or 3 broadcast as if it was
+// sent by a. If it succeeds, the content fields of b are filled and the
+// signature is verified.
+func decryptBroadcast(b *broadcast, a Address) error {
+	if b.StreamNumber != a.Stream {
+		return fmt.Errorf("decryptBroadcast: broadcast is from stream %d, not from %d", b.StreamNumber, a.Stream)
+	}
+	key, tag := broadcastKeys(a)
+	if b.BroadcastVersion >= 3 && b.Tag != tag {
+		return fmt.Errorf("decryptBroadcast: broadcast isn't from %v", a)
+	}
+	plaintext, err := decrypt(key, b.Encrypted)
+	if err != nil {
+		return err
+	}
+	d := *b
+	if err = parseBroadcastContent(bytes.NewReader(plaintext), &d); err != nil {
+		return err
+	}
+	if d.StreamNumber != b.StreamNumber {
+		return fmt.Errorf("decryptBroadcast: encrypted stream %d differs from the stream %d in the clear", d.StreamNumber, b.StreamNumber)
+	}
+	if d.AddressVersion != a.Version {
+		return fmt.Errorf("decryptBroadcast: encrypted address version %d differs from the version %d of %v", d.AddressVersion, a.Version, a)
+	}
+	d.AddressHash = a.Ripe
+	if err = d.verify(); err != nil {
+		return fmt.Errorf("decryptBroadcast: %v", err)
+	}
+	*b = d
+	return nil
 }
 
 func nullPadCommand(command string) string {
@@ -630,11 +1223,6 @@ func readUint64(r io.Reader) (x uint64) {
 	return x
 }
 
-func readBytes8(r io.Reader) (x [8]byte) {
-	check(binary.Read(r, binary.BigEndian, &x))
-	return x
-}
-
 // XXX return errors too
 func readVarIntList(r io.Reader) []uint64 {
 	length, _, err := encVarint.ReadVarInt(r)
@@ -652,6 +1240,19 @@ func readVarIntList(r io.Reader) []uint64 {
 	return x
 }
 
+// readVarBytes reads a varint length followed by that many bytes.
+func readVarBytes(r *bytes.Reader) (length uint64, b []byte, err error) {
+	if length, _, err = encVarint.ReadVarInt(r); err != nil {
+		return 0, nil, err
+	}
+	if length > uint64(r.Len()) {
+		return 0, nil, fmt.Errorf("length %d exceeds the %d bytes available", length, r.Len())
+	}
+	b = make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	return length, b, err
+}
+
 func readNetworkAddressList(r io.Reader) ([]extendedNetworkAddress, error) {
 	length, _, err := encVarint.ReadVarInt(r)
 	if err != nil {
@@ -669,6 +1270,18 @@ func readNetworkAddressList(r io.Reader) ([]extendedNetworkAddress, error) {
 	return addrs, nil
 }
 
+func writeNetworkAddressList(w io.Writer, addrs []extendedNetworkAddress) error {
+	if _, err := encVarint.WriteVarInt(w, uint64(len(addrs))); err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := binary.Write(w, binary.BigEndian, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func doubleHash(msg []byte) ([]byte, error) {
 	for i := 0; i < 2; i++ {
 		h := sha512.New()
@@ -701,10 +1314,17 @@ var initialTrial *big.Int // 99999999999999999999
 // https://bitmessage.org/wiki/Proof_of_work. Note that the difficulty of the
 // calculation is proportional to the size of the payload.
 func ProofOfWork(data []byte, initialNonce []byte) (nonceByte [8]byte, err error) {
+	return proofOfWork(data, initialNonce, averageProofOfWorkNonceTrialsPerByte, payloadLengthExtraBytes)
+}
+
+// proofOfWork is ProofOfWork with the difficulty parameters demanded by the
+// recipient of the data.
+func proofOfWork(data []byte, initialNonce []byte, nonceTrialsPerByte, extraBytes uint64) (nonceByte [8]byte, err error) {
 	if len(data) == 0 {
 		return nonceByte, fmt.Errorf("ProofOfWork received empty data.")
 	}
-	target := new(big.Int).Div(n2to64, big.NewInt(int64((len(data)+payloadLengthExtraBytes+8)*averageProofOfWorkNonceTrialsPerByte)))
+	// The length includes the nonce.
+	target := proofOfWorkTarget(len(data)+8, nonceTrialsPerByte, extraBytes)
 	if target.Cmp(new(big.Int)) == 0 { // target == 0
 		return nonceByte, fmt.Errorf("error calculating target")
 	}
@@ -738,6 +1358,44 @@ func ProofOfWork(data []byte, initialNonce []byte) (nonceByte [8]byte, err error
 	return nonceByte, nil
 }
 
+// proofOfWorkTarget returns the value the proof of work hash of data with the
+// provided length must not exceed.
+func proofOfWorkTarget(length int, nonceTrialsPerByte, extraBytes uint64) *big.Int {
+	d := new(big.Int).SetUint64(uint64(length) + extraBytes)
+	d.Mul(d, new(big.Int).SetUint64(nonceTrialsPerByte))
+	return d.Div(n2to64, d)
+}
+
+// doProofOfWork fills the nonce in the first 8 bytes of an object payload,
+// after calculating it over the rest of the payload.
+func doProofOfWork(payload []byte) error {
+	return doProofOfWorkFor(payload, averageProofOfWorkNonceTrialsPerByte, payloadLengthExtraBytes)
+}
+
+// doProofOfWorkFor is doProofOfWork with the difficulty parameters demanded by
+// the recipient of the object.
+func doProofOfWorkFor(payload []byte, nonceTrialsPerByte, extraBytes uint64) error {
+	nonce, err := proofOfWork(payload[8:], nil, nonceTrialsPerByte, extraBytes)
+	if err != nil {
+		return err
+	}
+	copy(payload, nonce[:])
+	return nil
+}
+
+// powDifficulty returns the proof of work parameters demanded by the owner of
+// k, which are never lower than the network defaults.
+func powDifficulty(k *PubKey) (nonceTrialsPerByte, extraBytes uint64) {
+	nonceTrialsPerByte, extraBytes = k.NonceTrialsPerByte, k.ExtraBytes
+	if nonceTrialsPerByte < averageProofOfWorkNonceTrialsPerByte {
+		nonceTrialsPerByte = averageProofOfWorkNonceTrialsPerByte
+	}
+	if extraBytes < payloadLengthExtraBytes {
+		extraBytes = payloadLengthExtraBytes
+	}
+	return nonceTrialsPerByte, extraBytes
+}
+
 func checkProofOfWork(data []byte, nonce [8]byte) error {
 	// From: https://bitmessage.org/wiki/Proof_of_work
 	initialHash := sha512.New()
@@ -749,12 +1407,12 @@ func checkProofOfWork(data []byte, nonce [8]byte) error {
 	}
 
 	POWValue := new(big.Int).SetBytes(h[0:8])
-	target := new(big.Int).Div(n2to64, big.NewInt(int64((len(data)+payloadLengthExtraBytes)*averageProofOfWorkNonceTrialsPerByte)))
+	target := proofOfWorkTarget(len(data), averageProofOfWorkNonceTrialsPerByte, payloadLengthExtraBytes)
 	// POWValue >= target:
 	if POWValue.Cmp(target) != 1 {
 		return nil
 	}
-	return fmt.Errorf("checkProofOfWork did not pass")
+	return misbehaving(banScoreInvalidPoW, fmt.Errorf("checkProofOfWork did not pass"))
 }
 
 // Bitmessage produces a hash for the provided message using a SHA-512 in the
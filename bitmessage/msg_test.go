@@ -17,11 +17,14 @@ package bitmessage
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	encVarint "github.com/nictuku/guardian/encoding/varint"
+	"io"
 	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -227,3 +230,377 @@ func TestPow(t *testing.T) {
 		t.Fatalf("ProofOfWork produced unexpected result: wanted %x, got %x", want.PowNonce, nonce)
 	}
 }
+
+var addressTests = []struct {
+	address string
+	version uint64
+	stream  uint64
+	ripe    string
+}{
+	// Address of the well-known "general" chan, from PyBitmessage.
+	{"BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r", 4, 1, "00a406532990cdd16a340e5e5d0182ab323b833b"},
+	// Same keys, encoded as an older version.
+	{"BM-2DAV89w336ovy6BUJnfVRD5B9qipFbRgmr", 3, 1, "00a406532990cdd16a340e5e5d0182ab323b833b"},
+}
+
+func TestAddressEncoding(t *testing.T) {
+	for i, tt := range addressTests {
+		a, err := DecodeAddress(tt.address)
+		if err != nil {
+			t.Fatalf("DecodeAddress(%q): %v (test %d)", tt.address, err, i)
+		}
+		if a.Version != tt.version || a.Stream != tt.stream {
+			t.Errorf("wanted version %d stream %d, got %d %d (test %d)", tt.version, tt.stream, a.Version, a.Stream, i)
+		}
+		if ripe := hex.EncodeToString(a.Ripe[:]); ripe != tt.ripe {
+			t.Errorf("ripe wanted %v got %v (test %d)", tt.ripe, ripe, i)
+		}
+		if s := a.String(); s != tt.address {
+			t.Errorf("encoding wanted %v got %v (test %d)", tt.address, s, i)
+		}
+	}
+}
+
+func TestDecodeAddressErrors(t *testing.T) {
+	badVersion := Address{Version: 1, Stream: 1}
+	badVersion.Ripe[19] = 1
+	tests := []struct {
+		address string
+		err     error
+	}{
+		{"BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8s", ErrAddressChecksum},
+		{badVersion.String(), ErrAddressVersion},
+		{"BM-", ErrAddressFormat},
+	}
+	for i, tt := range tests {
+		if _, err := DecodeAddress(tt.address); err != tt.err {
+			t.Errorf("DecodeAddress(%q) wanted err %v, got %v (test %d)", tt.address, tt.err, err, i)
+		}
+	}
+	if _, err := DecodeAddress("BM-0OIl"); err == nil {
+		t.Errorf("DecodeAddress accepted invalid base58 characters")
+	}
+}
+
+func TestNewIdentity(t *testing.T) {
+	id, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatalf("NewIdentity: %v", err)
+	}
+	if id.Ripe[0] != 0 {
+		t.Errorf("ripe %x should start with a null byte", id.Ripe)
+	}
+	a, err := DecodeAddress(id.String())
+	if err != nil {
+		t.Fatalf("DecodeAddress(%v): %v", id, err)
+	}
+	if a != id.Address {
+		t.Errorf("address changed after decoding: wanted %+v, got %+v", id.Address, a)
+	}
+}
+
+// Deterministic addresses generated from passphrases. The address of the
+// "general" chan is well known in the network, and its ripe is only
+// reproduced by the keys derived like PyBitmessage does.
+var deterministicTests = []struct {
+	passphrase    string
+	address       string
+	signingKey    string
+	encryptionKey string
+}{
+	{"general", "BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r",
+		"7fdc9a322403691c682abbeca222da2fd64da8534ec82782abed37c00feeda60",
+		"8814f17687e05fc3674f0a29b3dc30ee83addf79292f5526b93139bccdc11591"},
+}
+
+func TestNewDeterministicIdentity(t *testing.T) {
+	for i, tt := range deterministicTests {
+		id, err := NewDeterministicIdentity(tt.passphrase, streamOne)
+		if err != nil {
+			t.Fatalf("NewDeterministicIdentity(%q): %v (test %d)", tt.passphrase, err, i)
+		}
+		if id.String() != tt.address {
+			t.Errorf("address wanted %v got %v (test %d)", tt.address, id, i)
+		}
+		if k := hex.EncodeToString(id.SigningKey.Serialize()); k != tt.signingKey {
+			t.Errorf("signing key wanted %v got %v (test %d)", tt.signingKey, k, i)
+		}
+		if k := hex.EncodeToString(id.EncryptionKey.Serialize()); k != tt.encryptionKey {
+			t.Errorf("encryption key wanted %v got %v (test %d)", tt.encryptionKey, k, i)
+		}
+	}
+}
+
+func TestComposeMsg(t *testing.T) {
+	from, err := NewDeterministicIdentity("bitz", streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Skip the proof of work, which takes too long for a test.
+	m, err := newMsg(from, to.PubKey(), EncodingSimple, "hello", "world\nbye", nil)
+	if err != nil {
+		t.Fatalf("newMsg: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	writeMsg(buf, m)
+	if _, err = parseMsg(buf); err == nil {
+		t.Fatalf("parseMsg accepted a msg without proof of work")
+	}
+
+	n := new(Node)
+	n.receiveMsg(m)
+	if len(n.Inbox()) != 0 {
+		t.Fatalf("message delivered to a node without identities")
+	}
+	n.AddIdentity(to)
+	n.receiveMsg(m)
+	inbox := n.Inbox()
+	if len(inbox) != 1 {
+		t.Fatalf("wanted 1 message in the inbox, got %d", len(inbox))
+	}
+	got := inbox[0]
+	if got.From != from.Address || got.To != to.Address {
+		t.Errorf("wanted message from %v to %v, got from %v to %v", from, to, got.From, got.To)
+	}
+	if got.Subject != "hello" || got.Body != "world\nbye" {
+		t.Errorf("wrong content: %+v", got)
+	}
+}
+
+func TestPubKeyObjects(t *testing.T) {
+	id, err := NewDeterministicIdentity("bitz", streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The proof of work below was done for the version 3 pubkey. Version 4
+	// pubkeys are tested by TestPubKeyV4.
+	id.Version = 3
+	want := id.PubKey()
+	want.Time = 1366969543
+	want.PowNonce = [8]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x27, 0xb2, 0x80}
+	if err := want.sign(id.SigningKey); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := writePubKey(buf, *want); err != nil {
+		t.Fatalf("writePubKey: %v", err)
+	}
+	k, err := parsePubKey(buf)
+	if err != nil {
+		t.Fatalf("parsePubKey: %v", err)
+	}
+	if !reflect.DeepEqual(k, *want) {
+		t.Errorf("got %+v, wanted %+v", k, *want)
+	}
+	if k.Address() != id.Address {
+		t.Errorf("pubkey address wanted %v, got %v", id, k.Address())
+	}
+
+	wantReq := GetPubKey{
+		PowNonce:       [8]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x0e, 0xc6, 0x23},
+		Time:           1366969543,
+		AddressVersion: 3,
+		StreamNumber:   1,
+		PubKeyHash:     id.Ripe,
+	}
+	buf = new(bytes.Buffer)
+	if err := writeGetPubKey(buf, wantReq); err != nil {
+		t.Fatalf("writeGetPubKey: %v", err)
+	}
+	g, err := parseGetPubKey(buf)
+	if err != nil {
+		t.Fatalf("parseGetPubKey: %v", err)
+	}
+	if g != wantReq {
+		t.Errorf("got %+v, wanted %+v", g, wantReq)
+	}
+
+	// Pubkeys from the network are cached, even if we didn't ask for them.
+	n := new(Node)
+	n.pubKeys = make(map[[32]byte]*PubKey)
+	n.pubKeyRequests = make(map[[32]byte]time.Time)
+	n.receivePubKey(k)
+	if got := n.lookupPubKey(id.Address); got == nil || got.PublicEncryptionKey != want.PublicEncryptionKey {
+		t.Errorf("pubkey was not cached, got %+v", got)
+	}
+	n.pubKeys[id.tag()].Time = uint64(time.Now().Add(-pubKeyLifetime - time.Hour).Unix())
+	n.expirePubKeys()
+	if got := n.lookupPubKey(id.Address); got != nil {
+		t.Errorf("pubkey older than its lifetime was kept")
+	}
+}
+
+func TestPubKeyV4(t *testing.T) {
+	id, err := NewDeterministicIdentity("bitz", streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the tag and the encrypted fields are in the clear. Skip the
+	// proof of work, which takes too long for a test.
+	want := id.PubKey()
+	want.Time = 1366969543
+	if err := want.sign(id.SigningKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := encryptPubKey(want, id.Address); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := writePubKey(buf, *want); err != nil {
+		t.Fatalf("writePubKey: %v", err)
+	}
+	payload := buf.Bytes()
+	if !objectTime(payload).Equal(time.Unix(int64(want.Time), 0)) {
+		t.Errorf("objectTime got %v, wanted %v", objectTime(payload), time.Unix(int64(want.Time), 0))
+	}
+	tag := id.tag()
+	if !bytes.Equal(payload[18:50], tag[:]) || !bytes.Equal(payload[50:], want.Encrypted) {
+		t.Errorf("unexpected version 4 pubkey layout %x", payload)
+	}
+	k := PubKey{
+		Time:           want.Time,
+		AddressVersion: 4,
+		StreamNumber:   1,
+		Tag:            tag,
+		Encrypted:      want.Encrypted,
+	}
+	if k.decrypted() {
+		t.Fatalf("encrypted pubkey considered decrypted")
+	}
+	if err := decryptPubKey(&k, other.Address); err == nil {
+		t.Errorf("pubkey decrypted with the address of another identity")
+	}
+	enc := k
+	if err := decryptPubKey(&k, id.Address); err != nil {
+		t.Fatalf("decryptPubKey: %v", err)
+	}
+	if !reflect.DeepEqual(k, *want) {
+		t.Errorf("got %+v, wanted %+v", k, *want)
+	}
+
+	// Version 4 addresses are requested by their tag, which identifies
+	// our identity.
+	wantReq := GetPubKey{
+		PowNonce:       [8]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x56, 0x97, 0x95},
+		Time:           1366969543,
+		AddressVersion: 4,
+		StreamNumber:   1,
+		Tag:            tag,
+	}
+	buf = new(bytes.Buffer)
+	if err := writeGetPubKey(buf, wantReq); err != nil {
+		t.Fatalf("writeGetPubKey: %v", err)
+	}
+	g, err := parseGetPubKey(buf)
+	if err != nil {
+		t.Fatalf("parseGetPubKey: %v", err)
+	}
+	if g != wantReq {
+		t.Errorf("got %+v, wanted %+v", g, wantReq)
+	}
+	n := new(Node)
+	n.AddIdentity(other)
+	if found := n.findIdentity(g); found != nil {
+		t.Errorf("getpubkey for %v found %v", id, found)
+	}
+	n.AddIdentity(id)
+	if found := n.findIdentity(g); found != id {
+		t.Errorf("getpubkey for %v found %v", id, found)
+	}
+
+	// Pubkeys stay encrypted until their address is looked up.
+	n = new(Node)
+	n.pubKeys = make(map[[32]byte]*PubKey)
+	n.receivePubKey(enc)
+	if got := n.lookupPubKey(id.Address); got == nil || !got.decrypted() || got.PublicEncryptionKey != want.PublicEncryptionKey {
+		t.Errorf("lookupPubKey got %+v, wanted %+v", got, want)
+	}
+	// A newer pubkey with the same tag must come from the owner.
+	forged := enc
+	forged.Time++
+	forged.Encrypted = append([]byte(nil), enc.Encrypted...)
+	forged.Encrypted[len(forged.Encrypted)-1] ^= 1
+	n.receivePubKey(forged)
+	if got := n.pubKeys[tag]; got.Time != want.Time {
+		t.Errorf("verified pubkey replaced by a forged one")
+	}
+}
+
+func TestCachePubKey(t *testing.T) {
+	n := &Node{pubKeys: make(map[[32]byte]*PubKey)}
+	now := uint64(time.Now().Unix())
+	for i := 0; i < maxCachedPubKeys; i++ {
+		var tag [32]byte
+		binary.BigEndian.PutUint32(tag[:], uint32(i))
+		n.pubKeys[tag] = &PubKey{Time: now - uint64(i)}
+	}
+	var oldest [32]byte
+	binary.BigEndian.PutUint32(oldest[:], maxCachedPubKeys-1)
+
+	// A key older than all cached ones isn't worth keeping.
+	k := &PubKey{Time: now - maxCachedPubKeys}
+	tag := [32]byte{0xff}
+	n.cachePubKey(tag, k)
+	if _, ok := n.pubKeys[tag]; ok {
+		t.Errorf("pubkey older than the cached ones was added to a full cache")
+	}
+	k.Time = now
+	n.cachePubKey(tag, k)
+	if _, ok := n.pubKeys[tag]; !ok {
+		t.Errorf("new pubkey was not cached")
+	}
+	if _, ok := n.pubKeys[oldest]; ok {
+		t.Errorf("oldest pubkey was not evicted")
+	}
+	if len(n.pubKeys) != maxCachedPubKeys {
+		t.Errorf("got %d cached pubkeys, wanted %d", len(n.pubKeys), maxCachedPubKeys)
+	}
+}
+
+// Peers can send objects of any length, which must not crash the node.
+func TestParseShortPayload(t *testing.T) {
+	parsers := map[string]func(io.Reader) error{
+		"pubkey":    func(r io.Reader) error { _, err := parsePubKey(r); return err },
+		"getpubkey": func(r io.Reader) error { _, err := parseGetPubKey(r); return err },
+		"msg":       func(r io.Reader) error { _, err := parseMsg(r); return err },
+		"broadcast": func(r io.Reader) error { _, err := parseBroadcast(r); return err },
+	}
+	for command, parse := range parsers {
+		for _, payload := range [][]byte{nil, {1, 2, 3, 4, 5}} {
+			if err := parse(bytes.NewReader(payload)); err == nil {
+				t.Errorf("%v parser accepted a %d byte payload", command, len(payload))
+			}
+		}
+	}
+}
+
+func TestPowDifficulty(t *testing.T) {
+	tests := []struct {
+		k                       PubKey
+		nonceTrials, extraBytes uint64
+	}{
+		// Version 2 pubkeys don't have the fields.
+		{PubKey{}, averageProofOfWorkNonceTrialsPerByte, payloadLengthExtraBytes},
+		{PubKey{NonceTrialsPerByte: 1, ExtraBytes: 1}, averageProofOfWorkNonceTrialsPerByte, payloadLengthExtraBytes},
+		{PubKey{NonceTrialsPerByte: 1000, ExtraBytes: 20000}, 1000, 20000},
+	}
+	for i, tt := range tests {
+		nonceTrials, extraBytes := powDifficulty(&tt.k)
+		if nonceTrials != tt.nonceTrials || extraBytes != tt.extraBytes {
+			t.Errorf("got %d, %d, wanted %d, %d (test %d)", nonceTrials, extraBytes, tt.nonceTrials, tt.extraBytes, i)
+		}
+	}
+	def := proofOfWorkTarget(100, averageProofOfWorkNonceTrialsPerByte, payloadLengthExtraBytes)
+	if harder := proofOfWorkTarget(100, 1000, 20000); harder.Cmp(def) >= 0 {
+		t.Errorf("target for a higher difficulty %v isn't lower than the default %v", harder, def)
+	}
+}
@@ -34,6 +34,14 @@ type nodeMap map[ipPort]remoteNode
 type remoteNode struct {
 	conn          net.Conn
 	lastContacted time.Time
+	// inbound is set for nodes that connected to us.
+	inbound bool
+	// lastSeen is the most recent time the node was advertised with.
+	lastSeen time.Time
+	// lastAttempt is when we last tried to connect to the node, and
+	// failures is the number of consecutive attempts that failed.
+	lastAttempt time.Time
+	failures    int
 }
 
 func (n *Node) numStreamNodes(stream int) int {
@@ -66,17 +74,188 @@ func (n *Node) delNode(stream int, ipPort ipPort) {
 	log.Println("deleted node", ipPort, "from stream", stream)
 }
 
+// relayObject stores an object created by this node and advertises it to all
+// nodes connected to its stream, which then ask for it with getdata.
+func (n *Node) relayObject(stream uint64, command string, payload []byte) {
+	h := inventoryHash(payload)
+	n.objects.store(h, command, stream, payload)
+	for _, node := range n.connectedNodes[int(stream)] {
+		if node.conn != nil {
+			go writeInv(node.conn, []objHash{h})
+		}
+	}
+}
+
+// retryRequests asks other nodes for the objects whose getdata requests
+// timed out, then sends the queued requests. A request times out if none of
+// the objects of its batch arrived in getDataTimeout. Nodes that weren't asked
+// for the object yet are preferred, but the same node can be asked again,
+// since nodes drop requests beyond their rate limits. A request is dropped
+// after maxGetDataAttempts, or when no connected node has its object, so the
+// object is requested again when advertised.
+func (n *Node) retryRequests() {
+	for h, r := range n.objects.requests {
+		if r.batch == nil || time.Since(r.batch.progress) < getDataTimeout {
+			continue
+		}
+		var conn net.Conn
+		node := r.node
+		if r.attempts < maxGetDataAttempts {
+			node, conn = n.nextSource(h, r.tried)
+		}
+		if conn == nil {
+			log.Printf("giving up on retrieving %x after %d attempts", h, r.attempts)
+			n.objects.answered(r)
+			n.objects.finish(h, r)
+			continue
+		}
+		log.Printf("retrieving %x from %v, %v timed out", h, node, r.node)
+		n.objects.request(h, node, conn)
+	}
+	n.objects.pruneFinished()
+	n.objects.flushAll()
+}
+
+// nextSource returns a connected node that advertised the object, preferring
+// the ones not in tried, or a nil conn if there is none.
+func (n *Node) nextSource(h objHash, tried ipPortSet) (ipPort, net.Conn) {
+	info, ok := n.objects.inv.M[h]
+	if !ok {
+		return "", nil
+	}
+	var retry ipPort
+	var retryConn net.Conn
+	for node := range info.Nodes {
+		for _, nodes := range n.connectedNodes {
+			c, ok := nodes[node]
+			if !ok || c.conn == nil {
+				continue
+			}
+			if !tried[node] {
+				return node, c.conn
+			}
+			retry, retryConn = node, c.conn
+		}
+	}
+	return retry, retryConn
+}
+
+// serveGetData sends the requested objects that we have, each in a message
+// of its type. Unknown hashes are ignored.
+func (n *Node) serveGetData(g nodeGetData) {
+	var objs []StoredObject
+	for _, h := range g.hashes {
+		if o, ok := n.objects.get(h); ok {
+			objs = append(objs, o)
+		}
+	}
+	if len(objs) == 0 {
+		return
+	}
+	go func() {
+		for _, o := range objs {
+			writeMessage(g.w, o.Command, o.Payload)
+		}
+	}()
+}
+
+// acceptObject stores a valid object received from the node at from,
+// advertises it to all other nodes connected to its stream and processes it.
+// Objects we already have, and those older than their lifetime or too far in
+// the future, are ignored, so they can't be delivered twice or replayed. Nodes are only
+// supposed to send the objects we asked for with getdata, so the others add
+// to the ban score of the sender.
+func (n *Node) acceptObject(o nodeObject) {
+	h := inventoryHash(o.payload)
+	if !n.objects.solicited(h, o.from) {
+		n.misbehaved(nodeMisbehavior{o.from, banScoreUnsolicited})
+	}
+	if n.objects.has(h) {
+		return
+	}
+	t := objectTime(o.payload)
+	if time.Since(t) > objectLifetime(o.command) || t.After(time.Now().Add(maxObjectClockSkew)) {
+		log.Printf("acceptObject: dropping %v %x from %v with time %v", o.command, h, o.from, t)
+		return
+	}
+	n.objects.store(h, o.command, o.stream, o.payload)
+	for ipPort, node := range n.connectedNodes[int(o.stream)] {
+		if ipPort != o.from && node.conn != nil {
+			go writeInv(node.conn, []objHash{h})
+		}
+	}
+	switch obj := o.object.(type) {
+	case msg:
+		n.checkAck(h)
+		n.receiveMsg(obj)
+	case broadcast:
+		n.receiveBroadcast(obj)
+	case GetPubKey:
+		n.receiveGetPubKey(obj)
+	case PubKey:
+		n.receivePubKey(obj)
+	}
+}
+
+// goodNodes returns the addresses of up to maxAddrEntries nodes in the stream
+// that are worth advertising to other nodes, except for the node at skip.
+// Connected nodes come first, followed by known nodes contacted within
+// addrStaleAge. Nodes that connected to us are left out, since the port they
+// listen on is unknown, and so are unreachable and banned nodes.
+func (n *Node) goodNodes(stream int, skip ipPort) []extendedNetworkAddress {
+	var addrs []extendedNetworkAddress
+	add := func(ipPort ipPort, node remoteNode, t time.Time) {
+		if len(addrs) >= maxAddrEntries || ipPort == skip || node.inbound {
+			return
+		}
+		if n.unreachableNodes.test(ipPort) || n.banned(ipPort) {
+			return
+		}
+		addr := ipPort.toNetworkAddress()
+		addr.Time = uint64(t.Unix())
+		addr.Stream = uint32(stream)
+		addrs = append(addrs, addr)
+	}
+	for ipPort, node := range n.connectedNodes[stream] {
+		add(ipPort, node, time.Now())
+	}
+	for ipPort, node := range n.knownNodes[stream] {
+		t := node.lastSeen
+		if node.lastContacted.After(t) {
+			t = node.lastContacted
+		}
+		if _, ok := n.connectedNodes[stream][ipPort]; ok || node.failures > 0 || time.Since(t) > addrStaleAge {
+			continue
+		}
+		add(ipPort, node, t)
+	}
+	return addrs
+}
+
+// gossipAddrs sends the addresses of good nodes to all connected nodes, so
+// they can find each other.
+func (n *Node) gossipAddrs() {
+	for stream, nodes := range n.connectedNodes {
+		for ipPort, node := range nodes {
+			if node.conn != nil {
+				go writeAddr(node.conn, n.goodNodes(stream, ipPort))
+			}
+		}
+	}
+}
+
 func (n *Node) bootstrap() {
 	// Grab nodes from the config, add them to stream 1.
 	n.connectedNodes = make(streamNodes)
 	for _, ipPort := range n.cfg.Nodes {
-		go handshake(ipPort, remoteNode{}, n.resp)
+		n.learnNode(streamOne, ipPort, time.Now())
 	}
 
 	// Add network bootstrap nodes to stream 1.
 	for _, node := range findBootstrapNodes() {
-		go handshake(node, remoteNode{}, n.resp)
+		n.learnNode(streamOne, node, time.Now())
 	}
+	n.managePeers()
 }
 
 // findBootStrapNodes uses DNS resolution for finding bootstrap nodes for the
@@ -98,26 +277,18 @@ func findBootstrapNodes() (nodes []ipPort) {
 	return nodes
 }
 
-func handshake(ipPort ipPort, node remoteNode, resp responses) {
-	if !node.lastContacted.IsZero() && time.Since(node.lastContacted) < nodeConnectionRetryPeriod {
-		// This node was contacted recently, so wait before the next try.
+func handshake(ipPort ipPort, resp responses) {
+	conn, err := net.DialTimeout("tcp", string(ipPort), connectionTimeout)
+	if err != nil {
+		log.Printf("error connecting to node %v: %v", ipPort, err)
+		resp.delNodeChan <- ipPort.toNetworkAddress()
 		return
 	}
 
-	node.lastContacted = time.Now()
-	if node.conn == nil {
-		var err error
-		if node.conn, err = net.DialTimeout("tcp", string(ipPort), connectionTimeout); err != nil {
-			log.Printf("error connecting to node %v: %v", ipPort, err)
-			resp.delNodeChan <- ipPort.toNetworkAddress()
-			return
-		}
-
-		tcpConn := node.conn.(*net.TCPConn)
-		go handleConn(tcpConn, resp)
-	}
-	dest := node.conn.RemoteAddr().(*net.TCPAddr)
-	go writeVersion(node.conn, dest)
+	tcpConn := conn.(*net.TCPConn)
+	go handleConn(tcpConn, false, resp)
+	dest := conn.RemoteAddr().(*net.TCPAddr)
+	go writeVersion(conn, dest)
 }
 
 // check logs the provided error if it's not nil.
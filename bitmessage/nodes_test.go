@@ -15,7 +15,12 @@
 package bitmessage
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestFindBootstrapNodes(t *testing.T) {
@@ -24,3 +29,225 @@ func TestFindBootstrapNodes(t *testing.T) {
 		t.Fatal("findBootstrapNodes returned an empty set")
 	}
 }
+
+func TestGoodNodes(t *testing.T) {
+	n := &Node{connectedNodes: make(streamNodes), knownNodes: make(streamNodes)}
+	n.addNode(streamOne, "10.0.0.1:8444", remoteNode{lastContacted: time.Now()})
+	n.addNode(streamOne, "10.0.0.2:8444", remoteNode{lastContacted: time.Now()})
+	n.addNode(streamOne, "10.0.0.3:51234", remoteNode{lastContacted: time.Now(), inbound: true})
+	n.addKnownNode(streamOne, "10.0.0.4:8444", remoteNode{lastContacted: time.Now().Add(-time.Hour)})
+	n.addKnownNode(streamOne, "10.0.0.5:8444", remoteNode{lastContacted: time.Now().Add(-addrStaleAge * 2)})
+
+	got := make(map[ipPort]bool)
+	for _, addr := range n.goodNodes(streamOne, "10.0.0.2:8444") {
+		got[addr.ipPort()] = true
+	}
+	want := map[ipPort]bool{"10.0.0.1:8444": true, "10.0.0.4:8444": true}
+	if len(got) != len(want) {
+		t.Fatalf("goodNodes returned %v, wanted %v", got, want)
+	}
+	for ipPort := range want {
+		if !got[ipPort] {
+			t.Errorf("goodNodes did not return %v", ipPort)
+		}
+	}
+}
+
+func TestWriteAddr(t *testing.T) {
+	addrs := make([]extendedNetworkAddress, maxAddrEntries+1)
+	for i := range addrs {
+		addrs[i] = ipPort(fmt.Sprintf("10.0.%d.%d:8444", i/256, i%256)).toNetworkAddress()
+	}
+	buf := new(bytes.Buffer)
+	writeAddr(buf, addrs)
+	var got []extendedNetworkAddress
+	for buf.Len() > 0 {
+		m, err := readMessage(buf)
+		if err != nil {
+			t.Fatalf("readMessage: %v", err)
+		}
+		if m.h.command != "addr" {
+			t.Fatalf("got command %q, wanted addr", m.h.command)
+		}
+		batch, err := parseAddr(m.p)
+		if err != nil {
+			t.Fatalf("parseAddr: %v", err)
+		}
+		if len(batch) > maxAddrEntries {
+			t.Errorf("addr message has %d entries, limit is %d", len(batch), maxAddrEntries)
+		}
+		got = append(got, batch...)
+	}
+	if len(got) != len(addrs) {
+		t.Fatalf("got %d addresses, wanted %d", len(got), len(addrs))
+	}
+	for i := range addrs {
+		if got[i] != addrs[i] {
+			t.Errorf("address %d: got %v, wanted %v", i, got[i], addrs[i])
+		}
+	}
+
+	buf.Reset()
+	writeAddr(buf, nil)
+	if buf.Len() != 0 {
+		t.Errorf("writeAddr with no addresses wrote %d bytes", buf.Len())
+	}
+}
+
+func TestRetryRequests(t *testing.T) {
+	n := &Node{connectedNodes: make(streamNodes), objects: newObjStore(NewMemoryObjectStore())}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	n.addNode(streamOne, "10.0.0.2:8444", remoteNode{conn: local})
+
+	var h objHash
+	h[0] = 1
+	inv := newObjInventory()
+	inv.add(h, "10.0.0.1:8444")
+	inv.add(h, "10.0.0.2:8444")
+	n.objects.inv.merge(*inv)
+	n.objects.request(h, "10.0.0.1:8444", ioutil.Discard)
+	n.objects.flush("10.0.0.1:8444")
+
+	// Not timed out yet.
+	n.retryRequests()
+	if n.objects.requests[h].node != "10.0.0.1:8444" {
+		t.Fatalf("request retried before it timed out")
+	}
+
+	n.objects.requests[h].batch.progress = time.Now().Add(-getDataTimeout)
+	n.retryRequests()
+	if r := n.objects.requests[h]; r == nil || r.node != "10.0.0.2:8444" {
+		t.Fatalf("timed out request wasn't sent to the other node")
+	}
+	remote.SetDeadline(time.Now().Add(time.Second))
+	m, err := readMessage(remote)
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	invs, err := parseInv(m.p)
+	if m.h.command != "getdata" || err != nil || len(invs) != 1 || invs[0].Hash != h {
+		t.Errorf("got %v message %v (%v), wanted getdata for %x", m.h.command, invs, err, h)
+	}
+
+	// All nodes that have the object were tried, so the connected one is
+	// asked again.
+	n.objects.requests[h].batch.progress = time.Now().Add(-getDataTimeout)
+	n.retryRequests()
+	if r := n.objects.requests[h]; r == nil || r.node != "10.0.0.2:8444" || r.attempts != maxGetDataAttempts {
+		t.Fatalf("timed out request wasn't sent to the same node again: %+v", r)
+	}
+	if _, err := readMessage(remote); err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if p := n.objects.peers["10.0.0.2:8444"]; p.outstanding != 1 {
+		t.Errorf("got %d outstanding batches, wanted 1", p.outstanding)
+	}
+
+	n.objects.requests[h].batch.progress = time.Now().Add(-getDataTimeout)
+	n.retryRequests()
+	if _, ok := n.objects.requests[h]; ok {
+		t.Errorf("request kept after %d attempts", maxGetDataAttempts)
+	}
+	if p := n.objects.peers["10.0.0.2:8444"]; p.outstanding != 0 {
+		t.Errorf("got %d outstanding batches after giving up, wanted 0", p.outstanding)
+	}
+}
+
+func TestLateObject(t *testing.T) {
+	n := &Node{
+		connectedNodes: make(streamNodes),
+		objects:        newObjStore(NewMemoryObjectStore()),
+		bannedNodes:    make(banSet),
+		banScores:      make(map[string]banScore),
+	}
+	payload := testObject(time.Now(), 1)
+	h := inventoryHash(payload)
+	n.objects.request(h, "10.0.0.1:8444", ioutil.Discard)
+	n.objects.flush("10.0.0.1:8444")
+	// The node doesn't advertise the object anymore, so the request is
+	// abandoned when it times out.
+	n.objects.requests[h].batch.progress = time.Now().Add(-getDataTimeout)
+	n.retryRequests()
+	if _, ok := n.objects.requests[h]; ok {
+		t.Fatalf("request kept without nodes to ask")
+	}
+
+	// The node we asked is slow, not misbehaving.
+	n.acceptObject(nodeObject{"10.0.0.1:8444", "msg", streamOne, payload, nil})
+	if !n.objects.has(h) {
+		t.Errorf("late object wasn't stored")
+	}
+	if s := n.banScores["10.0.0.1"].score; s != 0 {
+		t.Errorf("late answer scored %d, wanted 0", s)
+	}
+	// Other nodes weren't asked for it.
+	n.acceptObject(nodeObject{"10.0.0.2:8444", "msg", streamOne, payload, nil})
+	if s := n.banScores["10.0.0.2"].score; s != banScoreUnsolicited {
+		t.Errorf("unsolicited object scored %d, wanted %d", s, banScoreUnsolicited)
+	}
+
+	// After the grace period, the object isn't expected anymore.
+	n.objects.finished[h] = finishedRequest{n.objects.finished[h].tried, time.Now().Add(-getDataGracePeriod)}
+	n.objects.pruneFinished()
+	n.acceptObject(nodeObject{"10.0.0.1:8444", "msg", streamOne, payload, nil})
+	if s := n.banScores["10.0.0.1"].score; s != banScoreUnsolicited {
+		t.Errorf("object after the grace period scored %d, wanted %d", s, banScoreUnsolicited)
+	}
+}
+
+func TestAcceptObject(t *testing.T) {
+	from, err := NewDeterministicIdentity("bitz", streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMsg(from, to.PubKey(), EncodingSimple, "hello", "world", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{
+		connectedNodes: make(streamNodes),
+		objects:        newObjStore(NewMemoryObjectStore()),
+		bannedNodes:    make(banSet),
+		banScores:      make(map[string]banScore),
+	}
+	n.AddIdentity(to)
+
+	buf := new(bytes.Buffer)
+	writeMsg(buf, m)
+	o := nodeObject{"10.0.0.1:8444", "msg", streamOne, buf.Bytes(), m}
+	n.objects.request(inventoryHash(o.payload), o.from, ioutil.Discard)
+	n.acceptObject(o)
+	if s := n.banScores["10.0.0.1"].score; s != 0 {
+		t.Errorf("requested object scored %d", s)
+	}
+	// The same object sent by another node without being asked.
+	o.from = "10.0.0.2:8444"
+	n.acceptObject(o)
+	if inbox := n.Inbox(); len(inbox) != 1 {
+		t.Fatalf("got %d messages in the inbox, wanted 1", len(inbox))
+	}
+	if s := n.banScores["10.0.0.2"].score; s != banScoreUnsolicited {
+		t.Errorf("unsolicited object scored %d, wanted %d", s, banScoreUnsolicited)
+	}
+
+	// A replay of an old message.
+	m.Time = uint64(time.Now().Add(-maxObjectAge - time.Hour).Unix())
+	buf.Reset()
+	writeMsg(buf, m)
+	n.acceptObject(nodeObject{"10.0.0.1:8444", "msg", streamOne, buf.Bytes(), m})
+	if inbox := n.Inbox(); len(inbox) != 1 {
+		t.Errorf("old message was delivered, got %d messages in the inbox", len(inbox))
+	}
+	// Pubkeys are accepted for as long as they are kept.
+	pubKey := testObject(time.Now().Add(-maxObjectAge-time.Hour), 1)
+	n.acceptObject(nodeObject{"10.0.0.1:8444", "pubkey", streamOne, pubKey, nil})
+	if !n.objects.has(inventoryHash(pubKey)) {
+		t.Errorf("pubkey within its lifetime was dropped")
+	}
+}
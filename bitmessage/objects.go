@@ -15,16 +15,16 @@
 package bitmessage
 
 import (
+	"encoding/binary"
 	"encoding/gob"
-	"fmt"
 	"io"
 	"log"
-	"strings"
-
-	camli "camlistore.org/pkg/client"
+	"os"
+	"time"
 )
 
-// This file implements storage for bitmessage objects using camlistore.
+// This file implements the tracking of which nodes have each object, and the
+// storage of the objects held by this node in an ObjectStore.
 
 // ipPortSet holds unique ipPorts.
 type ipPortSet map[ipPort]bool
@@ -33,67 +33,355 @@ type ipPortSet map[ipPort]bool
 type objHash [32]byte
 
 func newobjInfo() *objInfo {
-	return &objInfo{make(ipPortSet)}
+	return &objInfo{make(ipPortSet), time.Now()}
 }
 
 // objInfo is the metadata about a particular object.
 type objInfo struct {
 	// Nodes is the list of nodes that should have this object.
 	Nodes ipPortSet
+	// FirstSeen is when the object was first advertised to us.
+	FirstSeen time.Time
 }
 
 func (i *objInfo) addNode(addr ipPort) {
 	i.Nodes[addr] = true
 }
 
-func createObjStore() (*objStore, error) {
-	db := camli.New("localhost:3179")
-
-	return &objStore{newObjInventory(), db}, nil
+// newObjStore returns an objStore for the objects in db, whose metadata is
+// read once, here.
+func newObjStore(db ObjectStore) *objStore {
+	s := &objStore{newObjInventory(), db, make(map[objHash]objMeta), make(map[objHash]*objRequest), make(map[objHash]finishedRequest), make(map[ipPort]*peerRequests)}
+	err := db.Iterate(func(h [32]byte, o StoredObject) bool {
+		s.index[h] = newObjMeta(o)
+		return true
+	})
+	if err != nil {
+		log.Println("listing objects:", err)
+	}
+	return s
 }
 
-// objStore persists objects on disk and keeps track of metadata of each
-// object.
+// objStore persists objects using an ObjectStore and keeps track of metadata
+// of each object.
 type objStore struct {
 	inv *objectsInventory
-	db  *camli.Client
+	// db holds the objects this node has and advertises to others.
+	db ObjectStore
+	// index has the metadata of all objects in db, so only reading and
+	// writing objects has to go to db.
+	index map[objHash]objMeta
+	// requests are the objects we asked other nodes for, or are about to,
+	// and haven't received yet.
+	requests map[objHash]*objRequest
+	// finished are the requests that were answered or abandoned in the
+	// last getDataGracePeriod.
+	finished map[objHash]finishedRequest
+	// peers holds the getdata requests of each node.
+	peers map[ipPort]*peerRequests
+}
+
+// objMeta is what the node needs to know about a stored object, other than
+// its payload.
+type objMeta struct {
+	stream  uint64
+	expires time.Time
+}
+
+func newObjMeta(o StoredObject) objMeta {
+	return objMeta{o.Stream, o.Expires}
+}
+
+// objRequest is a getdata request waiting for its object.
+type objRequest struct {
+	// node is the node that was last asked for the object, at sent, in
+	// batch. sent is zero and batch is nil while the request is queued.
+	node  ipPort
+	sent  time.Time
+	batch *getDataBatch
+	// tried are all the nodes asked for the object so far, and attempts is
+	// the number of times it was asked for.
+	tried    ipPortSet
+	attempts int
+}
+
+// finishedRequest holds the nodes that were asked for an object, after its
+// request finished.
+type finishedRequest struct {
+	tried ipPortSet
+	at    time.Time
+}
+
+// getDataBatch is a getdata message sent to a node.
+type getDataBatch struct {
+	peer *peerRequests
+	// pending is the number of its objects that didn't arrive yet.
+	pending int
+	// progress is when the batch was sent, or when the last of its objects
+	// arrived.
+	progress time.Time
+}
+
+// peerRequests are the getdata requests for a node. They are queued and sent
+// in batches of up to maxGetDataServedPerRequest, which is as many as a node
+// serves per getdata, keeping at most getDataWindow batches outstanding.
+type peerRequests struct {
+	conn  io.Writer
+	queue []objHash
+	// outstanding is the number of batches sent whose objects didn't all
+	// arrive yet.
+	outstanding int
 }
 
-func (s *objStore) OffaddObjNode(h objHash, addr ipPort, conn io.Writer) {
-	s.inv.add(h, addr)
-	if s.shouldRetrieve(h) {
-		log.Println("retrieving %x [%v]", h, addr)
-		iv := inventoryVector{h}
-		writeGetData(conn, []inventoryVector{iv})
+// objectTime returns the time in the header of an object payload, which
+// comes after the PoW nonce. See readTime.
+func objectTime(payload []byte) time.Time {
+	if len(payload) < 12 {
+		return time.Time{}
 	}
+	if t := binary.BigEndian.Uint32(payload[8:12]); t != 0 || len(payload) < 16 {
+		return time.Unix(int64(t), 0)
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(payload[12:16])), 0)
 }
 
+// shouldRetrieve returns whether the object should be requested from nodes
+// that advertise it, which is the case unless we have it already or a request
+// for it is in flight.
 func (s *objStore) shouldRetrieve(h objHash) bool {
-	// XXX
-	return strings.HasPrefix(fmt.Sprintf("%x", h), "3")
+	if _, ok := s.requests[h]; ok {
+		return false
+	}
+	return !s.has(h)
+}
+
+// request queues a getdata request for the object to node. It's sent by the
+// next flush of the node's requests. Any earlier request for the object is
+// abandoned.
+func (s *objStore) request(h objHash, node ipPort, conn io.Writer) {
+	r, ok := s.requests[h]
+	if !ok {
+		r = &objRequest{tried: make(ipPortSet)}
+		s.requests[h] = r
+	}
+	s.answered(r)
+	r.node = node
+	r.sent = time.Time{}
+	r.tried[node] = true
+	r.attempts++
+	p, ok := s.peers[node]
+	if !ok {
+		p = &peerRequests{}
+		s.peers[node] = p
+	}
+	p.conn = conn
+	p.queue = append(p.queue, h)
+}
+
+// answered removes r from the batch it was sent in. The batch stops counting
+// as outstanding for its node once all its requests are answered.
+func (s *objStore) answered(r *objRequest) {
+	b := r.batch
+	if b == nil {
+		return
+	}
+	r.batch = nil
+	b.pending--
+	if b.pending > 0 {
+		return
+	}
+	b.peer.outstanding--
+}
+
+// flush sends the queued requests of node in getdata messages of up to
+// maxGetDataServedPerRequest, as long as it has less than getDataWindow
+// outstanding batches.
+func (s *objStore) flush(node ipPort) {
+	p, ok := s.peers[node]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for len(p.queue) > 0 && p.outstanding < getDataWindow {
+		b := &getDataBatch{peer: p, progress: now}
+		var invs []inventoryVector
+		for len(p.queue) > 0 && len(invs) < maxGetDataServedPerRequest {
+			h := p.queue[0]
+			p.queue = p.queue[1:]
+			// Skip requests that were answered or moved to another node
+			// while queued.
+			if r, ok := s.requests[h]; ok && r.node == node && r.sent.IsZero() {
+				r.sent = now
+				r.batch = b
+				invs = append(invs, inventoryVector{h})
+			}
+		}
+		if len(invs) == 0 {
+			break
+		}
+		b.pending = len(invs)
+		p.outstanding++
+		log.Printf("retrieving %d objects from %v", len(invs), node)
+		go writeGetData(p.conn, invs)
+	}
+}
+
+// flushAll sends the queued requests of all nodes that have room for them.
+func (s *objStore) flushAll() {
+	for node := range s.peers {
+		s.flush(node)
+	}
+}
+
+// finish removes the request for an object that arrived or was abandoned. The
+// nodes asked for it are remembered for getDataGracePeriod, so the late
+// answers of slow nodes aren't taken for unsolicited objects.
+func (s *objStore) finish(h objHash, r *objRequest) {
+	delete(s.requests, h)
+	s.finished[h] = finishedRequest{r.tried, time.Now()}
+}
+
+// solicited returns whether node was asked for the object, by a pending
+// request or one that finished in the last getDataGracePeriod.
+func (s *objStore) solicited(h objHash, node ipPort) bool {
+	if r, ok := s.requests[h]; ok && r.tried[node] {
+		return true
+	}
+	f, ok := s.finished[h]
+	return ok && f.tried[node] && time.Since(f.at) < getDataGracePeriod
+}
+
+// pruneFinished forgets the requests that finished over getDataGracePeriod
+// ago.
+func (s *objStore) pruneFinished() {
+	for h, f := range s.finished {
+		if time.Since(f.at) >= getDataGracePeriod {
+			delete(s.finished, h)
+		}
+	}
+}
+
+// dropNode forgets the requests queued for a node that disconnected. The
+// ones already sent are retried with other nodes when they time out.
+func (s *objStore) dropNode(node ipPort) {
+	p, ok := s.peers[node]
+	if !ok {
+		return
+	}
+	for _, h := range p.queue {
+		if r, ok := s.requests[h]; ok && r.node == node && r.sent.IsZero() {
+			s.finish(h, r)
+		}
+	}
+	delete(s.peers, node)
+}
+
+// store saves an object received or created by this node. Errors from the
+// ObjectStore are logged, since there's nothing else the node can do about
+// them.
+func (s *objStore) store(h objHash, command string, stream uint64, payload []byte) {
+	o := StoredObject{
+		Command:  command,
+		Stream:   stream,
+		Payload:  payload,
+		Received: time.Now(),
+		Expires:  objectTime(payload).Add(objectLifetime(command)),
+	}
+	if err := s.db.Put(h, o); err != nil {
+		log.Printf("storing %v %x: %v", command, h, err)
+	} else {
+		s.index[h] = newObjMeta(o)
+	}
+	if r, ok := s.requests[h]; ok {
+		if r.batch != nil {
+			r.batch.progress = time.Now()
+		}
+		s.answered(r)
+		s.finish(h, r)
+		// Don't wait for the periodic flush if the node has room for more
+		// batches.
+		if p, ok := s.peers[r.node]; ok && p.outstanding < getDataWindow {
+			s.flush(r.node)
+		}
+	}
 }
 
-func (s *objStore) store(h objHash, data []byte) {}
+func (s *objStore) get(h objHash) (StoredObject, bool) {
+	o, err := s.db.Get(h)
+	if err != nil {
+		if err != ErrObjectNotFound {
+			log.Printf("reading object %x: %v", h, err)
+		}
+		return o, false
+	}
+	return o, true
+}
+
+func (s *objStore) has(h objHash) bool {
+	_, ok := s.index[h]
+	return ok
+}
+
+// hashes returns the hashes of the objects in the stream that are still
+// within their lifetime, so they can be advertised to other nodes.
+func (s *objStore) hashes(stream uint64) []objHash {
+	var hashes []objHash
+	now := time.Now()
+	for h, m := range s.index {
+		if m.stream == stream && now.Before(m.expires) {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// expire deletes the objects that are past their lifetime.
+func (s *objStore) expire() {
+	deleted := 0
+	now := time.Now()
+	for h, m := range s.index {
+		if !now.After(m.expires) {
+			continue
+		}
+		if err := s.db.Delete(h); err != nil {
+			log.Printf("deleting expired object %x: %v", h, err)
+			continue
+		}
+		delete(s.index, h)
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("deleted %d expired objects", deleted)
+	}
+}
+
+// objectLifetime is how long objects of the provided type are kept after
+// their creation time.
+func objectLifetime(command string) time.Duration {
+	if command == "pubkey" {
+		return pubKeyLifetime
+	}
+	return maxObjectAge
+}
 
 // mergeInventory is called when we receive the inventory list from another
 // node. We must record that in our map of objects-to-nodes and retrieve any
 // pending items if necessary.
-func (s *objStore) mergeInventory(inv2 objectsInventory, conn io.Writer) {
+func (s *objStore) mergeInventory(inv2 objectsInventory, from ipPort, conn io.Writer) {
 	s.inv.merge(inv2)
 	for h, _ := range inv2.M {
 		if s.shouldRetrieve(h) {
-			log.Printf("==================== retrieving %x", h)
-			iv := inventoryVector{h}
-
-			writeGetData(conn, []inventoryVector{iv})
+			s.request(h, from, conn)
 		}
 	}
+	s.flush(from)
 }
 
 // invSource indicates a source that can receive writes requesting for a data.
 type nodeInv struct {
-	w   io.Writer
-	inv objectsInventory
+	from ipPort
+	w    io.Writer
+	inv  objectsInventory
 }
 
 func newObjInventory() *objectsInventory {
@@ -126,19 +414,63 @@ func (inv objectsInventory) merge(inv2 objectsInventory) {
 		for addr, _ := range m.Nodes {
 			inv.add(h, addr)
 		}
+		if m.FirstSeen.Before(inv.M[h].FirstSeen) {
+			inv.M[h].FirstSeen = m.FirstSeen
+		}
+	}
+}
+
+// prune removes the objects that were first seen long enough ago to have
+// expired.
+func (inv objectsInventory) prune() {
+	for h, m := range inv.M {
+		if time.Since(m.FirstSeen) > maxObjectAge {
+			delete(inv.M, h)
+		}
 	}
-	// TODO: Persist the objectsInventory somewhere.
 }
 
 // save writes the contents of inv in gob format to w.
-// Used for testing.
 func (inv objectsInventory) save(w io.Writer) error {
 	g := gob.NewEncoder(w)
 	return g.Encode(inv)
 }
 
 // load decodes the gob object in r and replaces inv with it.
-func (inv objectsInventory) load(r io.Reader) error {
+func (inv *objectsInventory) load(r io.Reader) error {
+	var inv2 objectsInventory
 	g := gob.NewDecoder(r)
-	return g.Decode(&inv)
+	if err := g.Decode(&inv2); err != nil {
+		return err
+	}
+	if inv2.M == nil {
+		inv2.M = make(map[objHash]*objInfo)
+	}
+	*inv = inv2
+	return nil
+}
+
+// saveInventory prunes the inventory and writes it to the file at p.
+func (s *objStore) saveInventory(p string) error {
+	s.inv.prune()
+	return saveFile(p, s.inv.save)
+}
+
+// loadInventory replaces the inventory with the one saved at p, if any, and
+// prunes it.
+func (s *objStore) loadInventory(p string) error {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.inv.load(f); err != nil {
+		return err
+	}
+	s.inv.prune()
+	log.Printf("loaded the inventory of %d objects", len(s.inv.M))
+	return nil
 }
@@ -16,8 +16,14 @@ package bitmessage
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSave(t *testing.T) {
@@ -37,7 +43,255 @@ func TestSave(t *testing.T) {
 	if err := objectsNew.load(buf); err != nil {
 		t.Fatalf("object load error %v", err)
 	}
-	if !reflect.DeepEqual(objects, objectsNew) {
+	// Decoded times have no monotonic clock reading, so compare them
+	// separately.
+	for h, info := range objects.M {
+		info2, ok := objectsNew.M[h]
+		if !ok || !reflect.DeepEqual(info.Nodes, info2.Nodes) || !info.FirstSeen.Equal(info2.FirstSeen) {
+			t.Fatalf("objects differ. Decoding failed?")
+		}
+	}
+	if len(objects.M) != len(objectsNew.M) {
 		t.Fatalf("objects differ. Decoding failed?")
 	}
 }
+
+func TestInventoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitz-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "inventory")
+
+	s := newObjStore(NewMemoryObjectStore())
+	if err := s.loadInventory(p); err != nil {
+		t.Fatalf("loadInventory without a saved inventory: %v", err)
+	}
+	var fresh, old objHash
+	fresh[0], old[0] = 1, 2
+	s.inv.add(fresh, "127.0.0.1:8444")
+	s.inv.add(old, "127.0.0.1:8444")
+	s.inv.M[old].FirstSeen = time.Now().Add(-maxObjectAge * 2)
+	if err := s.saveInventory(p); err != nil {
+		t.Fatalf("saveInventory: %v", err)
+	}
+
+	s = newObjStore(NewMemoryObjectStore())
+	if err := s.loadInventory(p); err != nil {
+		t.Fatalf("loadInventory: %v", err)
+	}
+	if len(s.inv.M) != 1 || s.inv.M[fresh] == nil || !s.inv.M[fresh].Nodes["127.0.0.1:8444"] {
+		t.Errorf("loaded inventory %v, wanted only %x from 127.0.0.1:8444", s.inv.M, fresh)
+	}
+}
+
+// testObject returns an object payload with the given time and a distinct
+// content, without a valid PoW.
+func testObject(t time.Time, content byte) []byte {
+	payload := make([]byte, 13)
+	binary.BigEndian.PutUint32(payload[8:12], uint32(t.Unix()))
+	payload[12] = content
+	return payload
+}
+
+func TestObjStoreHashes(t *testing.T) {
+	s := newObjStore(NewMemoryObjectStore())
+	fresh := testObject(time.Now(), 1)
+	old := testObject(time.Now().Add(-maxObjectAge*2), 2)
+	otherStream := testObject(time.Now(), 3)
+	// Pubkeys are advertised for longer than other objects.
+	oldPubKey := testObject(time.Now().Add(-maxObjectAge*2), 4)
+	s.store(inventoryHash(fresh), "msg", streamOne, fresh)
+	s.store(inventoryHash(old), "msg", streamOne, old)
+	s.store(inventoryHash(otherStream), "msg", 2, otherStream)
+	s.store(inventoryHash(oldPubKey), "pubkey", streamOne, oldPubKey)
+
+	if !s.has(inventoryHash(old)) {
+		t.Errorf("has(%x) = false, wanted true", inventoryHash(old))
+	}
+	hashes := s.hashes(streamOne)
+	want := map[objHash]bool{inventoryHash(fresh): true, inventoryHash(oldPubKey): true}
+	if len(hashes) != len(want) || !want[hashes[0]] || !want[hashes[1]] {
+		t.Errorf("hashes(%d) = %x, wanted only %x and %x", streamOne, hashes, inventoryHash(fresh), inventoryHash(oldPubKey))
+	}
+}
+
+func TestWriteInv(t *testing.T) {
+	hashes := make([]objHash, maxInventoryEntries+1)
+	for i := range hashes {
+		binary.BigEndian.PutUint32(hashes[i][:], uint32(i))
+	}
+	buf := new(bytes.Buffer)
+	writeInv(buf, hashes)
+	var got []inventoryVector
+	for buf.Len() > 0 {
+		m, err := readMessage(buf)
+		if err != nil {
+			t.Fatalf("readMessage: %v", err)
+		}
+		if m.h.command != "inv" {
+			t.Fatalf("got command %q, wanted inv", m.h.command)
+		}
+		invs, err := parseInv(m.p)
+		if err != nil {
+			t.Fatalf("parseInv: %v", err)
+		}
+		if len(invs) > maxInventoryEntries {
+			t.Errorf("inv message has %d entries, limit is %d", len(invs), maxInventoryEntries)
+		}
+		got = append(got, invs...)
+	}
+	if len(got) != len(hashes) {
+		t.Fatalf("got %d inventory vectors, wanted %d", len(got), len(hashes))
+	}
+	for i := range hashes {
+		if got[i].Hash != hashes[i] {
+			t.Fatalf("inventory vector %d: got %x, wanted %x", i, got[i].Hash, hashes[i])
+		}
+	}
+}
+
+func TestObjStoreExpire(t *testing.T) {
+	s := newObjStore(NewMemoryObjectStore())
+	fresh := testObject(time.Now(), 1)
+	oldMsg := testObject(time.Now().Add(-maxObjectAge*2), 2)
+	oldPubKey := testObject(time.Now().Add(-maxObjectAge*2), 3)
+	s.store(inventoryHash(fresh), "msg", streamOne, fresh)
+	s.store(inventoryHash(oldMsg), "msg", streamOne, oldMsg)
+	s.store(inventoryHash(oldPubKey), "pubkey", streamOne, oldPubKey)
+	s.expire()
+	if !s.has(inventoryHash(fresh)) {
+		t.Errorf("expire deleted a fresh msg")
+	}
+	if s.has(inventoryHash(oldMsg)) {
+		t.Errorf("expire kept an expired msg")
+	}
+	if !s.has(inventoryHash(oldPubKey)) {
+		t.Errorf("expire deleted a pubkey still within its lifetime")
+	}
+}
+
+func TestObjStoreIndex(t *testing.T) {
+	db := NewMemoryObjectStore()
+	s := newObjStore(db)
+	fresh := testObject(time.Now(), 1)
+	old := testObject(time.Now().Add(-maxObjectAge*2), 2)
+	s.store(inventoryHash(fresh), "msg", streamOne, fresh)
+	s.store(inventoryHash(old), "msg", streamOne, old)
+
+	// The metadata of the stored objects is read when the node starts.
+	s = newObjStore(db)
+	if !s.has(inventoryHash(fresh)) || !s.has(inventoryHash(old)) {
+		t.Fatalf("objects in the ObjectStore missing from the index")
+	}
+	if hashes := s.hashes(streamOne); len(hashes) != 1 || hashes[0] != inventoryHash(fresh) {
+		t.Errorf("hashes returned %x, wanted only the fresh object", hashes)
+	}
+	s.expire()
+	if ok, _ := db.Has(inventoryHash(old)); ok {
+		t.Errorf("expired object not deleted from the ObjectStore")
+	}
+}
+
+func TestShouldRetrieve(t *testing.T) {
+	s := newObjStore(NewMemoryObjectStore())
+	payload := testObject(time.Now(), 1)
+	h := inventoryHash(payload)
+	for _, node := range []ipPort{"127.0.0.1:8444", "127.0.0.2:8444"} {
+		inv := newObjInventory()
+		inv.add(h, node)
+		s.mergeInventory(*inv, node, ioutil.Discard)
+	}
+	r := s.requests[h]
+	if r == nil || r.node != "127.0.0.1:8444" || r.sent.IsZero() {
+		t.Fatalf("request for %x not sent to the first node that advertised it: %+v", h, r)
+	}
+	if p := s.peers["127.0.0.2:8444"]; p != nil && p.outstanding+len(p.queue) > 0 {
+		t.Errorf("object requested from the second node while in flight")
+	}
+	s.store(h, "msg", streamOne, payload)
+	if _, ok := s.requests[h]; ok {
+		t.Errorf("request for %x still tracked after the object was stored", h)
+	}
+	if p := s.peers["127.0.0.1:8444"]; p.outstanding != 0 {
+		t.Errorf("node has %d outstanding requests after answering, wanted 0", p.outstanding)
+	}
+	if s.shouldRetrieve(h) {
+		t.Errorf("shouldRetrieve(%x) = true for a stored object", h)
+	}
+}
+
+func TestGetDataBatches(t *testing.T) {
+	s := newObjStore(NewMemoryObjectStore())
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	node := ipPort("127.0.0.1:8444")
+	inv := newObjInventory()
+	for i := 0; i < 3; i++ {
+		var h objHash
+		h[0] = byte(i)
+		inv.add(h, node)
+	}
+	s.mergeInventory(*inv, node, local)
+	remote.SetDeadline(time.Now().Add(time.Second))
+	m, err := readMessage(remote)
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	invs, err := parseInv(m.p)
+	if m.h.command != "getdata" || err != nil || len(invs) != 3 {
+		t.Fatalf("got %v message with %d entries (%v), wanted a single getdata with 3", m.h.command, len(invs), err)
+	}
+
+	// Batches are capped at what a node serves per getdata, and only
+	// getDataWindow of them are sent at once.
+	for i := 0; i < 3; i++ {
+		var h objHash
+		h[0] = byte(i)
+		s.store(h, "msg", streamOne, testObject(time.Now(), 1))
+	}
+	p := s.peers[node]
+	if p.outstanding != 0 {
+		t.Fatalf("got %d outstanding batches after answering, wanted 0", p.outstanding)
+	}
+	inv = newObjInventory()
+	var first objHash
+	for i := 0; i < getDataWindow*maxGetDataServedPerRequest+1; i++ {
+		var h objHash
+		binary.BigEndian.PutUint32(h[:], uint32(1000+i))
+		if i == 0 {
+			first = h
+		}
+		inv.add(h, node)
+	}
+	s.mergeInventory(*inv, node, local)
+	for i := 0; i < getDataWindow; i++ {
+		m, err := readMessage(remote)
+		if err != nil {
+			t.Fatalf("readMessage: %v", err)
+		}
+		if invs, err := parseInv(m.p); err != nil || len(invs) != maxGetDataServedPerRequest {
+			t.Fatalf("got a getdata with %d entries (%v), wanted %d", len(invs), err, maxGetDataServedPerRequest)
+		}
+	}
+	if p.outstanding != getDataWindow || len(p.queue) != 1 {
+		t.Fatalf("got %d outstanding batches and %d queued requests, wanted %d and 1", p.outstanding, len(p.queue), getDataWindow)
+	}
+
+	// A batch is answered when all its objects arrive. Objects that don't
+	// arrive are retried when the batch times out.
+	batch := s.requests[first].batch
+	for h, r := range s.requests {
+		if r.batch == batch {
+			s.store(h, "msg", streamOne, testObject(time.Now(), 1))
+		}
+	}
+	if _, err := readMessage(remote); err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if p.outstanding != getDataWindow || len(p.queue) != 0 {
+		t.Errorf("got %d outstanding batches and %d queued requests, wanted %d and 0", p.outstanding, len(p.queue), getDataWindow)
+	}
+}
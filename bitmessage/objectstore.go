@@ -0,0 +1,111 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+// This file defines the ObjectStore interface used by the node to keep the
+// objects it relays, and an implementation that holds them in memory.
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrObjectNotFound is returned by ObjectStore.Get for unknown hashes.
+var ErrObjectNotFound = errors.New("bitmessage: object not found")
+
+// StoredObject is a msg, broadcast, getpubkey or pubkey object, as relayed in
+// the network, together with the metadata needed to expire it.
+type StoredObject struct {
+	// Command is the type of the message that carries the object.
+	Command string
+	Stream  uint64
+	Payload []byte
+	// Received is when the object was stored by this node.
+	Received time.Time
+	// Expires is when the object is no longer relayed and can be deleted.
+	Expires time.Time
+}
+
+// ObjectStore keeps the objects known by a node, indexed by their inventory
+// hash. Implementations must be safe for concurrent use.
+type ObjectStore interface {
+	// Put stores o, replacing any object with the same hash.
+	Put(h [32]byte, o StoredObject) error
+	// Get returns the object with hash h, or ErrObjectNotFound.
+	Get(h [32]byte) (StoredObject, error)
+	Has(h [32]byte) (bool, error)
+	// Delete removes the object with hash h. Deleting an unknown hash is not
+	// an error.
+	Delete(h [32]byte) error
+	// Iterate calls f for each stored object, until f returns false. The
+	// store must not be modified by f. The objects may be passed without
+	// their Payload, for stores that keep it elsewhere. The node only
+	// iterates when it starts, to read the metadata of the objects.
+	Iterate(f func(h [32]byte, o StoredObject) bool) error
+}
+
+// MemoryObjectStore is an ObjectStore that holds objects in memory, so they
+// are lost when the program exits.
+type MemoryObjectStore struct {
+	sync.RWMutex
+	objects map[[32]byte]StoredObject
+}
+
+func NewMemoryObjectStore() *MemoryObjectStore {
+	return &MemoryObjectStore{objects: make(map[[32]byte]StoredObject)}
+}
+
+func (s *MemoryObjectStore) Put(h [32]byte, o StoredObject) error {
+	s.Lock()
+	defer s.Unlock()
+	s.objects[h] = o
+	return nil
+}
+
+func (s *MemoryObjectStore) Get(h [32]byte) (StoredObject, error) {
+	s.RLock()
+	defer s.RUnlock()
+	o, ok := s.objects[h]
+	if !ok {
+		return o, ErrObjectNotFound
+	}
+	return o, nil
+}
+
+func (s *MemoryObjectStore) Has(h [32]byte) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.objects[h]
+	return ok, nil
+}
+
+func (s *MemoryObjectStore) Delete(h [32]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.objects, h)
+	return nil
+}
+
+func (s *MemoryObjectStore) Iterate(f func(h [32]byte, o StoredObject) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for h, o := range s.objects {
+		if !f(h, o) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build camlistore
+// +build camlistore
+
+package bitmessage
+
+// This file implements an ObjectStore that keeps object payloads in a
+// camlistore server. It's only built with the camlistore build tag, so the
+// package doesn't depend on camlistore otherwise.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"camlistore.org/pkg/blob"
+	camli "camlistore.org/pkg/client"
+)
+
+// CamliObjectStore is an ObjectStore that uploads object payloads to a
+// camlistore server. Camlistore addresses blobs by their own hash, so the
+// index from inventory hashes to blobs, and the object metadata, are kept in
+// memory and in a local file.
+type CamliObjectStore struct {
+	sync.RWMutex
+	client *camli.Client
+	index  map[[32]byte]camliObject
+	// indexPath is the file with the index, as a log of camliIndexEntry
+	// values in JSON. log is open for appending to it.
+	indexPath string
+	log       *os.File
+}
+
+// camliObject is a StoredObject without its payload, which is in the blob
+// ref.
+type camliObject struct {
+	ref  blob.Ref
+	meta StoredObject
+}
+
+// camliIndexEntry records that an object was stored, or deleted if Deleted
+// is set.
+type camliIndexEntry struct {
+	Hash    string
+	Ref     string       `json:",omitempty"`
+	Meta    StoredObject `json:",omitempty"`
+	Deleted bool         `json:",omitempty"`
+}
+
+// NewCamliObjectStore returns an ObjectStore using the camlistore server at
+// the provided address, like "localhost:3179". The index of the objects is
+// kept in the file at indexPath, so they can still be found after a restart.
+func NewCamliObjectStore(server, indexPath string) (*CamliObjectStore, error) {
+	s := &CamliObjectStore{
+		client:    camli.New(server),
+		index:     make(map[[32]byte]camliObject),
+		indexPath: indexPath,
+	}
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadIndex replays the index log, then rewrites it with only the objects
+// still stored, so it doesn't grow forever.
+func (s *CamliObjectStore) loadIndex() error {
+	f, err := os.Open(s.indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		d := json.NewDecoder(f)
+		for {
+			var e camliIndexEntry
+			if err := d.Decode(&e); err != nil {
+				if err != io.EOF {
+					// A crash while appending leaves a partial entry at
+					// the end.
+					log.Printf("reading the camlistore index %v: %v", s.indexPath, err)
+				}
+				break
+			}
+			s.apply(e)
+		}
+		f.Close()
+	}
+	err = saveFile(s.indexPath, func(w io.Writer) error {
+		e := json.NewEncoder(w)
+		for h, c := range s.index {
+			if err := e.Encode(camliIndexEntry{Hash: hex.EncodeToString(h[:]), Ref: c.ref.String(), Meta: c.meta}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.log, err = os.OpenFile(s.indexPath, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// apply updates the index with an entry read from the log.
+func (s *CamliObjectStore) apply(e camliIndexEntry) {
+	var h [32]byte
+	b, err := hex.DecodeString(e.Hash)
+	if err != nil || len(b) != len(h) {
+		return
+	}
+	copy(h[:], b)
+	if e.Deleted {
+		delete(s.index, h)
+		return
+	}
+	if ref, ok := blob.Parse(e.Ref); ok {
+		s.index[h] = camliObject{ref, e.Meta}
+	}
+}
+
+// appendIndex writes e to the index log. The caller must hold the lock.
+func (s *CamliObjectStore) appendIndex(e camliIndexEntry) error {
+	return json.NewEncoder(s.log).Encode(e)
+}
+
+func (s *CamliObjectStore) Put(h [32]byte, o StoredObject) error {
+	ref := blob.SHA1FromBytes(o.Payload)
+	_, err := s.client.Upload(&camli.UploadHandle{
+		BlobRef:  ref,
+		Size:     int64(len(o.Payload)),
+		Contents: bytes.NewReader(o.Payload),
+	})
+	if err != nil {
+		return err
+	}
+	o.Payload = nil
+	s.Lock()
+	defer s.Unlock()
+	if err := s.appendIndex(camliIndexEntry{Hash: hex.EncodeToString(h[:]), Ref: ref.String(), Meta: o}); err != nil {
+		return err
+	}
+	s.index[h] = camliObject{ref, o}
+	return nil
+}
+
+func (s *CamliObjectStore) Get(h [32]byte) (StoredObject, error) {
+	s.RLock()
+	c, ok := s.index[h]
+	s.RUnlock()
+	if !ok {
+		return StoredObject{}, ErrObjectNotFound
+	}
+	rc, _, err := s.client.FetchStreaming(c.ref)
+	if err != nil {
+		return StoredObject{}, err
+	}
+	defer rc.Close()
+	o := c.meta
+	o.Payload, err = ioutil.ReadAll(rc)
+	return o, err
+}
+
+func (s *CamliObjectStore) Has(h [32]byte) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.index[h]
+	return ok, nil
+}
+
+func (s *CamliObjectStore) Delete(h [32]byte) error {
+	s.Lock()
+	c, ok := s.index[h]
+	if !ok {
+		s.Unlock()
+		return nil
+	}
+	err := s.appendIndex(camliIndexEntry{Hash: hex.EncodeToString(h[:]), Deleted: true})
+	if err == nil {
+		delete(s.index, h)
+	}
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveBlob(c.ref)
+}
+
+// Iterate passes the objects without their payloads, so nothing is fetched
+// from the server.
+func (s *CamliObjectStore) Iterate(f func(h [32]byte, o StoredObject) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for h, c := range s.index {
+		if !f(h, c.meta) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+// This file implements an ObjectStore that keeps each object in a file, in a
+// directory sharded by the first byte of the object hashes.
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskObjectStore is an ObjectStore that persists objects on disk, so they
+// survive restarts. Each object is written atomically to its own file, which
+// makes it safe for concurrent use.
+type DiskObjectStore struct {
+	dir string
+}
+
+// NewDiskObjectStore returns an ObjectStore that keeps objects under dir,
+// creating it if necessary. Temporary files left behind by a crash while
+// writing objects are removed.
+func NewDiskObjectStore(dir string) (*DiskObjectStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	shards, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, shard.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			// saveFile names its temporary files after id, which can't be
+			// mistaken for the hex names of objects.
+			if strings.HasPrefix(file.Name(), id) {
+				os.Remove(filepath.Join(dir, shard.Name(), file.Name()))
+			}
+		}
+	}
+	return &DiskObjectStore{dir}, nil
+}
+
+func (s *DiskObjectStore) path(h [32]byte) string {
+	name := hex.EncodeToString(h[:])
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *DiskObjectStore) Put(h [32]byte, o StoredObject) error {
+	p := s.path(h)
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return err
+	}
+	return saveFile(p, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(o)
+	})
+}
+
+func (s *DiskObjectStore) Get(h [32]byte) (o StoredObject, err error) {
+	f, err := os.Open(s.path(h))
+	if os.IsNotExist(err) {
+		return o, ErrObjectNotFound
+	}
+	if err != nil {
+		return o, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&o)
+	return o, err
+}
+
+func (s *DiskObjectStore) Has(h [32]byte) (bool, error) {
+	_, err := os.Stat(s.path(h))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DiskObjectStore) Delete(h [32]byte) error {
+	err := os.Remove(s.path(h))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *DiskObjectStore) Iterate(f func(h [32]byte, o StoredObject) bool) error {
+	shards, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, shard.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			// Skips temporary files being written and anything else
+			// that isn't an object.
+			var h [32]byte
+			b, err := hex.DecodeString(file.Name())
+			if err != nil || len(b) != len(h) {
+				continue
+			}
+			copy(h[:], b)
+			o, err := s.Get(h)
+			if err == ErrObjectNotFound {
+				// Deleted since the directory was read.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !f(h, o) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
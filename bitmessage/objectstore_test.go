@@ -0,0 +1,131 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testObjectStore checks the behavior common to all ObjectStore
+// implementations.
+func testObjectStore(t *testing.T, s ObjectStore) {
+	payload := testObject(time.Now(), 1)
+	h := inventoryHash(payload)
+	if _, err := s.Get(h); err != ErrObjectNotFound {
+		t.Fatalf("Get of an unknown hash: got %v, wanted %v", err, ErrObjectNotFound)
+	}
+	want := StoredObject{
+		Command:  "msg",
+		Stream:   streamOne,
+		Payload:  payload,
+		Received: time.Unix(time.Now().Unix(), 0),
+		Expires:  objectTime(payload).Add(maxObjectAge),
+	}
+	if err := s.Put(h, want); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if ok, err := s.Has(h); !ok || err != nil {
+		t.Fatalf("Has after Put: got %v, %v", ok, err)
+	}
+	got, err := s.Get(h)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Command != want.Command || got.Stream != want.Stream || !bytes.Equal(got.Payload, want.Payload) ||
+		!got.Received.Equal(want.Received) || !got.Expires.Equal(want.Expires) {
+		t.Errorf("Get: got %+v, wanted %+v", got, want)
+	}
+
+	other := testObject(time.Now(), 2)
+	if err := s.Put(inventoryHash(other), StoredObject{Command: "pubkey", Stream: streamOne, Payload: other}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	seen := make(map[[32]byte]bool)
+	if err := s.Iterate(func(h [32]byte, o StoredObject) bool {
+		seen[h] = true
+		return true
+	}); err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	if len(seen) != 2 || !seen[h] || !seen[inventoryHash(other)] {
+		t.Errorf("Iterate visited %d objects, wanted both stored objects", len(seen))
+	}
+	calls := 0
+	s.Iterate(func(h [32]byte, o StoredObject) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("Iterate called f %d times after it returned false", calls)
+	}
+
+	if err := s.Delete(h); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ok, _ := s.Has(h); ok {
+		t.Errorf("Has after Delete returned true")
+	}
+	if err := s.Delete(h); err != nil {
+		t.Errorf("Delete of an unknown hash: %v", err)
+	}
+}
+
+func TestMemoryObjectStore(t *testing.T) {
+	testObjectStore(t, NewMemoryObjectStore())
+}
+
+func TestDiskObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitz-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewDiskObjectStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testObjectStore(t, s)
+
+	// Objects must survive reopening the store.
+	payload := testObject(time.Now(), 3)
+	h := inventoryHash(payload)
+	if err := s.Put(h, StoredObject{Command: "msg", Stream: streamOne, Payload: payload}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// A temporary file left behind by a crash.
+	leftover := filepath.Join(filepath.Dir(s.path(h)), id+"123")
+	if err := ioutil.WriteFile(leftover, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewDiskObjectStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := s.Get(h)
+	if err != nil {
+		t.Fatalf("Get after reopening: %v", err)
+	}
+	if !bytes.Equal(o.Payload, payload) {
+		t.Errorf("Get after reopening: got payload %x, wanted %x", o.Payload, payload)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("temporary file not removed when reopening the store: %v", err)
+	}
+}
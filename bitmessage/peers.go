@@ -0,0 +1,272 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// This file implements the peer manager, which keeps numNodesForMainStream
+// outbound connections by promoting known nodes when connections drop, and
+// limits the inbound connections. Like the other methods of Node, these can
+// only be executed by the main server routine.
+
+// learnNode records that a node was advertised at the provided time. Times
+// in the future are taken as now, so nodes can't be ranked above the others
+// by lying about them, and nodes not seen for addrStaleAge are ignored.
+func (n *Node) learnNode(stream int, ipPort ipPort, seen time.Time) {
+	now := time.Now()
+	if seen.After(now) {
+		seen = now
+	}
+	if now.Sub(seen) > addrStaleAge {
+		return
+	}
+	node := n.knownNodes[stream][ipPort]
+	if seen.After(node.lastSeen) {
+		node.lastSeen = seen
+	}
+	n.addKnownNode(stream, ipPort, node)
+}
+
+// connected records a successful connection to a known node.
+func (n *Node) connected(stream int, ipPort ipPort) {
+	delete(n.dialing, ipPort)
+	node, ok := n.knownNodes[stream][ipPort]
+	if !ok {
+		return
+	}
+	node.lastContacted = time.Now()
+	node.failures = 0
+	n.addKnownNode(stream, ipPort, node)
+}
+
+// dialFailed records a failed connection attempt to a known node. Nodes
+// that fail too many times in a row are considered unreachable.
+func (n *Node) dialFailed(stream int, ipPort ipPort) {
+	delete(n.dialing, ipPort)
+	node, ok := n.knownNodes[stream][ipPort]
+	if !ok {
+		return
+	}
+	node.failures++
+	n.addKnownNode(stream, ipPort, node)
+	if node.failures >= maxConnectionFailures {
+		n.unreachableNodes.add(ipPort)
+	}
+}
+
+// unreachableSet holds the nodes that couldn't be reached, with the time
+// their entries expire. The port is part of the key, so a host isn't
+// blacklisted because of a single bad port.
+type unreachableSet map[ipPort]time.Time
+
+func (u unreachableSet) add(ipPort ipPort) {
+	u[ipPort] = time.Now().Add(unreachableNodeTTL)
+}
+
+func (u unreachableSet) test(ipPort ipPort) bool {
+	expires, ok := u[ipPort]
+	return ok && time.Now().Before(expires)
+}
+
+// expire removes the entries that expired.
+func (u unreachableSet) expire() {
+	now := time.Now()
+	for ipPort, expires := range u {
+		if !now.Before(expires) {
+			delete(u, ipPort)
+		}
+	}
+}
+
+// accept handles a connection made to our listening port, unless it comes
+// from a banned host or exceeds the inbound connection limits.
+func (n *Node) accept(conn *net.TCPConn) {
+	addr := ipPort(conn.RemoteAddr().String())
+	if n.banned(addr) {
+		log.Println("refusing connection from banned node", addr)
+		conn.Close()
+		return
+	}
+	if err := n.inboundLimit(addr); err != nil {
+		log.Printf("refusing connection from %v: %v", addr, err)
+		conn.Close()
+		return
+	}
+	n.inboundNodes[addr] = true
+	go handleConn(conn, true, n.resp)
+}
+
+// inboundLimit returns an error if accepting another connection from addr
+// would exceed MaxInboundPeers, MaxInboundPeersPerIP or
+// MaxInboundPeersPerSubnet. Connections that are still in the version
+// exchange count too.
+func (n *Node) inboundLimit(addr ipPort) error {
+	if len(n.inboundNodes) >= MaxInboundPeers {
+		return fmt.Errorf("%d inbound connections already", len(n.inboundNodes))
+	}
+	host, subnet := addr.host(), addr.subnet()
+	sameHost, sameSubnet := 0, 0
+	for ipPort := range n.inboundNodes {
+		if ipPort.host() == host {
+			sameHost++
+		}
+		if ipPort.subnet() == subnet {
+			sameSubnet++
+		}
+	}
+	if sameHost >= MaxInboundPeersPerIP {
+		return fmt.Errorf("%d inbound connections from %v already", sameHost, host)
+	}
+	if sameSubnet >= MaxInboundPeersPerSubnet {
+		return fmt.Errorf("%d inbound connections from subnet %v already", sameSubnet, subnet)
+	}
+	return nil
+}
+
+// numOutbound returns the number of connections we made, or are making, to
+// nodes of the stream.
+func (n *Node) numOutbound(stream int) int {
+	count := len(n.dialing)
+	for _, node := range n.connectedNodes[stream] {
+		if !node.inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// managePeers connects to known nodes until there are numNodesForMainStream
+// outbound connections in the main stream.
+func (n *Node) managePeers() {
+	need := numNodesForMainStream - n.numOutbound(streamOne)
+	if need <= 0 {
+		return
+	}
+	for _, ipPort := range n.peerCandidates(streamOne, need) {
+		node := n.knownNodes[streamOne][ipPort]
+		node.lastAttempt = time.Now()
+		n.addKnownNode(streamOne, ipPort, node)
+		n.dialing[ipPort] = true
+		log.Println("handshaking with", ipPort)
+		go handshake(ipPort, n.resp)
+	}
+}
+
+// peerCandidates returns up to max known nodes of the stream to connect to,
+// best first. Nodes that are connected, being dialed, unreachable, banned, or
+// that failed recently are left out. Nodes from /16 subnets we aren't
+// connected to yet are preferred, so a single network can't surround us.
+func (n *Node) peerCandidates(stream int, max int) []ipPort {
+	now := time.Now()
+	var candidates []ipPort
+	for ipPort, node := range n.knownNodes[stream] {
+		if _, ok := n.connectedNodes[stream][ipPort]; ok || n.dialing[ipPort] {
+			continue
+		}
+		if now.Sub(node.lastAttempt) < retryBackoff(node.failures) {
+			continue
+		}
+		if n.unreachableNodes.test(ipPort) || n.banned(ipPort) {
+			continue
+		}
+		candidates = append(candidates, ipPort)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return peerScore(n.knownNodes[stream][candidates[i]], now) > peerScore(n.knownNodes[stream][candidates[j]], now)
+	})
+
+	subnets := make(map[string]bool)
+	for ipPort := range n.connectedNodes[stream] {
+		subnets[ipPort.subnet()] = true
+	}
+	for ipPort := range n.dialing {
+		subnets[ipPort.subnet()] = true
+	}
+	var picked, rest []ipPort
+	for _, ipPort := range candidates {
+		if len(picked) == max {
+			break
+		}
+		if subnets[ipPort.subnet()] {
+			rest = append(rest, ipPort)
+			continue
+		}
+		subnets[ipPort.subnet()] = true
+		picked = append(picked, ipPort)
+	}
+	// Fill up with nodes from subnets we already use if there aren't enough
+	// others.
+	for _, ipPort := range rest {
+		if len(picked) == max {
+			break
+		}
+		picked = append(picked, ipPort)
+	}
+	return picked
+}
+
+// peerScore ranks known nodes as connection candidates. The score is minus
+// the hours since the node was last seen or contacted, so recently active
+// nodes come first. Nodes we connected to before get a day of advantage, and
+// each recent failure costs half a day.
+func peerScore(node remoteNode, now time.Time) float64 {
+	last := node.lastSeen
+	if node.lastContacted.After(last) {
+		last = node.lastContacted
+	}
+	score := -now.Sub(last).Hours()
+	if !node.lastContacted.IsZero() {
+		score += 24
+	}
+	score -= 12 * float64(node.failures)
+	return score
+}
+
+// retryBackoff is how long to wait before connecting again to a node that
+// failed the provided number of times in a row. It doubles with each failure,
+// up to nodeConnectionRetryPeriod.
+func retryBackoff(failures int) time.Duration {
+	backoff := connectionRetryBackoff
+	for i := 0; i < failures && backoff < nodeConnectionRetryPeriod; i++ {
+		backoff *= 2
+	}
+	if backoff > nodeConnectionRetryPeriod {
+		backoff = nodeConnectionRetryPeriod
+	}
+	return backoff
+}
+
+// subnet returns the /16 subnet of IPv4 addresses, or the /32 of IPv6
+// addresses.
+func (ipPort ipPort) subnet() string {
+	host, _, err := net.SplitHostPort(string(ipPort))
+	if err != nil {
+		return string(ipPort)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
@@ -0,0 +1,152 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPeerCandidates(t *testing.T) {
+	n := &Node{
+		connectedNodes:   make(streamNodes),
+		knownNodes:       make(streamNodes),
+		dialing:          make(map[ipPort]bool),
+		unreachableNodes: make(unreachableSet),
+	}
+	now := time.Now()
+	n.addNode(streamOne, "10.1.0.1:8444", remoteNode{})
+	n.learnNode(streamOne, "10.1.0.1:8444", now)
+	// Same subnet as the connected node.
+	n.learnNode(streamOne, "10.1.0.2:8444", now)
+	n.learnNode(streamOne, "10.2.0.1:8444", now.Add(-time.Hour))
+	n.learnNode(streamOne, "10.2.0.2:8444", now.Add(-2*time.Hour))
+	n.learnNode(streamOne, "10.3.0.1:8444", now.Add(-150*time.Minute))
+	// Failed recently.
+	n.learnNode(streamOne, "10.4.0.1:8444", now)
+	n.addKnownNode(streamOne, "10.4.0.1:8444", remoteNode{lastSeen: now, lastAttempt: now, failures: 1})
+	// Unreachable.
+	n.learnNode(streamOne, "10.5.0.1:8444", now)
+	n.unreachableNodes.add("10.5.0.1:8444")
+
+	got := n.peerCandidates(streamOne, 3)
+	want := []ipPort{"10.2.0.1:8444", "10.3.0.1:8444", "10.1.0.2:8444"}
+	if len(got) != len(want) {
+		t.Fatalf("peerCandidates returned %v, wanted %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("peerCandidates returned %v, wanted %v", got, want)
+			break
+		}
+	}
+}
+
+func TestPeerScore(t *testing.T) {
+	now := time.Now()
+	seen := remoteNode{lastSeen: now.Add(-time.Hour)}
+	contacted := remoteNode{lastSeen: now.Add(-time.Hour), lastContacted: now.Add(-2 * time.Hour)}
+	failing := remoteNode{lastSeen: now, failures: 3}
+	if peerScore(contacted, now) <= peerScore(seen, now) {
+		t.Errorf("a node we connected to before doesn't rank above one that was only advertised")
+	}
+	if peerScore(failing, now) >= peerScore(seen, now) {
+		t.Errorf("a failing node doesn't rank below one that wasn't tried")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	if b := retryBackoff(0); b != connectionRetryBackoff {
+		t.Errorf("retryBackoff(0) = %v, wanted %v", b, connectionRetryBackoff)
+	}
+	if b := retryBackoff(1); b != 2*connectionRetryBackoff {
+		t.Errorf("retryBackoff(1) = %v, wanted %v", b, 2*connectionRetryBackoff)
+	}
+	if b := retryBackoff(100); b != nodeConnectionRetryPeriod {
+		t.Errorf("retryBackoff(100) = %v, wanted %v", b, nodeConnectionRetryPeriod)
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	for _, tt := range []struct {
+		ipPort ipPort
+		subnet string
+	}{
+		{"192.168.11.8:8444", "192.168.0.0"},
+		{"[2001:db8:1:2::1]:8444", "2001:db8::"},
+	} {
+		if s := tt.ipPort.subnet(); s != tt.subnet {
+			t.Errorf("%v.subnet() = %q, wanted %q", tt.ipPort, s, tt.subnet)
+		}
+	}
+}
+
+func TestUnreachableSet(t *testing.T) {
+	u := make(unreachableSet)
+	u.add("10.0.0.1:8444")
+	if !u.test("10.0.0.1:8444") {
+		t.Errorf("added node isn't unreachable")
+	}
+	if u.test("10.0.0.1:8445") {
+		t.Errorf("another port of an unreachable host is unreachable")
+	}
+	u["10.0.0.1:8444"] = time.Now().Add(-time.Second)
+	if u.test("10.0.0.1:8444") {
+		t.Errorf("expired node is still unreachable")
+	}
+	u.expire()
+	if len(u) != 0 {
+		t.Errorf("expire kept %d entries, wanted 0", len(u))
+	}
+}
+
+func TestInboundLimit(t *testing.T) {
+	n := &Node{inboundNodes: make(ipPortSet)}
+	for i := 0; i < MaxInboundPeersPerIP; i++ {
+		n.inboundNodes[ipPort(fmt.Sprintf("10.1.0.1:%d", 50000+i))] = true
+	}
+	if err := n.inboundLimit("10.1.0.1:60000"); err == nil {
+		t.Errorf("accepted more than MaxInboundPeersPerIP connections from a host")
+	}
+	if err := n.inboundLimit("10.1.0.2:60000"); err != nil {
+		t.Errorf("refused a connection from another host: %v", err)
+	}
+	for i := MaxInboundPeersPerIP; i < MaxInboundPeersPerSubnet; i++ {
+		n.inboundNodes[ipPort(fmt.Sprintf("10.1.1.%d:8444", i))] = true
+	}
+	if err := n.inboundLimit("10.1.2.1:8444"); err == nil {
+		t.Errorf("accepted more than MaxInboundPeersPerSubnet connections from a subnet")
+	}
+	for i := len(n.inboundNodes); i < MaxInboundPeers; i++ {
+		n.inboundNodes[ipPort(fmt.Sprintf("10.%d.0.1:8444", 2+i))] = true
+	}
+	if err := n.inboundLimit("192.168.0.1:8444"); err == nil {
+		t.Errorf("accepted more than MaxInboundPeers connections")
+	}
+}
+
+func TestLearnNode(t *testing.T) {
+	n := &Node{knownNodes: make(streamNodes)}
+	now := time.Now()
+	n.learnNode(streamOne, "10.1.0.1:8444", now.Add(24*365*time.Hour))
+	if seen := n.knownNodes[streamOne]["10.1.0.1:8444"].lastSeen; seen.After(time.Now()) {
+		t.Errorf("node advertised in the future was recorded as seen at %v", seen)
+	}
+	n.learnNode(streamOne, "10.2.0.1:8444", now.Add(-addrStaleAge-time.Minute))
+	if _, ok := n.knownNodes[streamOne]["10.2.0.1:8444"]; ok {
+		t.Errorf("stale node was learned")
+	}
+}
@@ -0,0 +1,583 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+// This file implements the composition of messages sent by our identities,
+// and the pipeline that delivers them: if the recipient's public key is
+// unknown, a getpubkey is sent and the message waits for the pubkey to arrive.
+// The msg is then encrypted to that key, the proof of work is done and the
+// object is relayed to the network. Finally, the message is acknowledged when
+// the ack embedded in it shows up.
+//
+// Broadcasts from our identities don't need a public key or an ack: they are
+// queued, composed and relayed, but otherwise follow the same pipeline.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SendState is the progress of an outgoing message.
+type SendState int
+
+const (
+	// StateAwaitingPubKey means the public key of the recipient is unknown
+	// and was requested from the network.
+	StateAwaitingPubKey SendState = iota
+	// StateDoingPoW means the message is being encrypted and the proof of
+	// work is being calculated.
+	StateDoingPoW
+	// StateSent means the msg object was relayed to the network.
+	StateSent
+	// StateAcknowledged means the recipient acknowledged the message.
+	StateAcknowledged
+	// StateFailed means the message could not be composed.
+	StateFailed
+	// StateQueued means the broadcast waits for the node to compose it.
+	StateQueued
+)
+
+var sendStateNames = []string{"awaiting pubkey", "doing PoW", "sent", "acknowledged", "failed", "queued"}
+
+func (s SendState) String() string {
+	if s < 0 || int(s) >= len(sendStateNames) {
+		return fmt.Sprintf("SendState(%d)", int(s))
+	}
+	return sendStateNames[s]
+}
+
+// OutgoingMessage is a message or broadcast sent by one of our identities.
+type OutgoingMessage struct {
+	// ID identifies the message in the outbox.
+	ID   int
+	From Address
+	// To is empty for broadcasts.
+	To        Address
+	Broadcast bool
+	Encoding  uint64
+	Subject   string
+	Body      string
+	State     SendState
+	// Updated is when the state last changed.
+	Updated time.Time
+}
+
+func (out *OutgoingMessage) setState(s SendState) {
+	if out.Broadcast {
+		log.Printf("broadcast %d from %v: %v", out.ID, out.From, s)
+	} else {
+		log.Printf("message %d from %v to %v: %v", out.ID, out.From, out.To, s)
+	}
+	out.State = s
+	out.Updated = time.Now()
+}
+
+// Send queues a message from one of our identities to the address to. It
+// returns the ID of the message in the Outbox, where its progress can be
+// followed. The message is only delivered while Run is executing.
+func (n *Node) Send(from Address, to string, encoding uint64, subject, body string) (int, error) {
+	toAddr, err := DecodeAddress(to)
+	if err != nil {
+		return 0, err
+	}
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	if _, ok := n.mailbox.identities[from.Ripe]; !ok {
+		return 0, fmt.Errorf("bitmessage: %v is not one of our identities", from)
+	}
+	out := &OutgoingMessage{
+		ID:       len(n.mailbox.outbox) + 1,
+		From:     from,
+		To:       toAddr,
+		Encoding: encoding,
+		Subject:  subject,
+		Body:     body,
+	}
+	out.setState(StateAwaitingPubKey)
+	n.mailbox.outbox = append(n.mailbox.outbox, out)
+	return out.ID, nil
+}
+
+// Broadcast queues a broadcast from one of our identities to everyone that
+// subscribes to it. It returns the ID of the broadcast in the Outbox, where
+// its progress can be followed. The broadcast is only relayed while Run is
+// executing.
+func (n *Node) Broadcast(from Address, encoding uint64, subject, body string) (int, error) {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	if _, ok := n.mailbox.identities[from.Ripe]; !ok {
+		return 0, fmt.Errorf("bitmessage: %v is not one of our identities", from)
+	}
+	return n.queueBroadcast(from, encoding, subject, body).ID, nil
+}
+
+// queueBroadcast adds a broadcast to the outbox. The mailbox lock must be held.
+func (n *Node) queueBroadcast(from Address, encoding uint64, subject, body string) *OutgoingMessage {
+	out := &OutgoingMessage{
+		ID:        len(n.mailbox.outbox) + 1,
+		From:      from,
+		Broadcast: true,
+		Encoding:  encoding,
+		Subject:   subject,
+		Body:      body,
+	}
+	out.setState(StateQueued)
+	n.mailbox.outbox = append(n.mailbox.outbox, out)
+	return out
+}
+
+// Outbox returns the messages sent by our identities, oldest first.
+func (n *Node) Outbox() []OutgoingMessage {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	outbox := make([]OutgoingMessage, len(n.mailbox.outbox))
+	for i, out := range n.mailbox.outbox {
+		outbox[i] = *out
+	}
+	return outbox
+}
+
+// localObject is an object created by this node, with the proof of work
+// done.
+type localObject struct {
+	command string
+	stream  uint64
+	payload []byte
+	err     error
+	// For msgs, out is the message being sent and ackHash is the inventory
+	// hash of the ack embedded in it. Messages to chans have no ack, so
+	// ackHash is zero.
+	out     *OutgoingMessage
+	ackHash objHash
+}
+
+// processOutbox advances the queued broadcasts and the messages waiting for
+// public keys. If the key is known, the message is composed in a separate
+// goroutine that reports back to n.resp.powChan. Otherwise the key is
+// requested from the network.
+func (n *Node) processOutbox() {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	for _, out := range n.mailbox.outbox {
+		if out.State != StateAwaitingPubKey && out.State != StateQueued {
+			continue
+		}
+		from, ok := n.mailbox.identities[out.From.Ripe]
+		if !ok {
+			continue
+		}
+		if out.Broadcast {
+			out.setState(StateDoingPoW)
+			go composeBroadcast(from, out, *out, n.resp.powChan)
+			continue
+		}
+		to := n.lookupPubKey(out.To)
+		if to == nil {
+			n.requestPubKey(out.To)
+			continue
+		}
+		// Messages to chans are not acknowledged.
+		withAck := true
+		if id, ok := n.mailbox.identities[out.To.Ripe]; ok && id.Chan != "" {
+			withAck = false
+		}
+		out.setState(StateDoingPoW)
+		go composeMsg(from, to, out, *out, withAck, n.resp.powChan)
+	}
+}
+
+// lookupPubKey finds the public key of one of our identities or of a node we
+// got a pubkey from. Version 4 pubkeys are decrypted the first time their
+// address is looked up. The mailbox lock must be held.
+func (n *Node) lookupPubKey(addr Address) *PubKey {
+	if id, ok := n.mailbox.identities[addr.Ripe]; ok {
+		return id.PubKey()
+	}
+	tag := addr.tag()
+	k, ok := n.pubKeys[tag]
+	if !ok || k.decrypted() {
+		return k
+	}
+	d := *k
+	if err := decryptPubKey(&d, addr); err != nil {
+		log.Printf("dropping the pubkey with the tag of %v: %v", addr, err)
+		delete(n.pubKeys, tag)
+		return nil
+	}
+	n.pubKeys[tag] = &d
+	return &d
+}
+
+// requestPubKey sends a getpubkey for addr, unless one was sent recently.
+func (n *Node) requestPubKey(addr Address) {
+	tag := addr.tag()
+	if t, ok := n.pubKeyRequests[tag]; ok && time.Since(t) < getPubKeyRetryPeriod {
+		return
+	}
+	n.pubKeyRequests[tag] = time.Now()
+	go func() {
+		g := GetPubKey{
+			Time:           uint64(time.Now().Unix()),
+			AddressVersion: addr.Version,
+			StreamNumber:   addr.Stream,
+			PubKeyHash:     addr.Ripe,
+		}
+		if addr.Version >= 4 {
+			g.PubKeyHash = [20]byte{}
+			g.Tag = tag
+		}
+		buf := new(bytes.Buffer)
+		writeGetPubKey(buf, g)
+		payload := buf.Bytes()
+		err := doProofOfWork(payload)
+		n.resp.powChan <- localObject{command: "getpubkey", stream: addr.Stream, payload: payload, err: err}
+	}()
+}
+
+// receivePubKey is called for each valid pubkey received from the network.
+// All keys are cached, so sending to their owners won't need a getpubkey.
+// Version 4 pubkeys are cached encrypted, since only their tag is known.
+func (n *Node) receivePubKey(k PubKey) {
+	tag := k.tag()
+	if old, ok := n.pubKeys[tag]; ok {
+		if old.Time >= k.Time {
+			return
+		}
+		// Only the owner of the address can replace a verified key.
+		if old.decrypted() && !k.decrypted() && decryptPubKey(&k, old.Address()) != nil {
+			return
+		}
+	}
+	n.cachePubKey(tag, &k)
+	if _, ok := n.pubKeyRequests[tag]; !ok {
+		return
+	}
+	log.Printf("received a pubkey we requested, with tag %x", tag)
+	delete(n.pubKeyRequests, tag)
+	n.processOutbox()
+}
+
+// cachePubKey adds k to the cached pubkeys. Once there are maxCachedPubKeys,
+// the oldest key is evicted, since it's the first to expire anyway.
+func (n *Node) cachePubKey(tag [32]byte, k *PubKey) {
+	if _, ok := n.pubKeys[tag]; !ok && len(n.pubKeys) >= maxCachedPubKeys {
+		var oldest *PubKey
+		var oldestTag [32]byte
+		for t, c := range n.pubKeys {
+			if oldest == nil || c.Time < oldest.Time {
+				oldest, oldestTag = c, t
+			}
+		}
+		if oldest.Time >= k.Time {
+			return
+		}
+		delete(n.pubKeys, oldestTag)
+	}
+	n.pubKeys[tag] = k
+}
+
+// expirePubKeys drops the cached pubkeys that are older than pubKeyLifetime,
+// like the pubkey objects themselves.
+func (n *Node) expirePubKeys() {
+	for tag, k := range n.pubKeys {
+		if time.Since(time.Unix(int64(k.Time), 0)) > pubKeyLifetime {
+			delete(n.pubKeys, tag)
+		}
+	}
+}
+
+// receiveGetPubKey publishes the pubkey of one of our identities if it was
+// requested, unless that was done recently.
+func (n *Node) receiveGetPubKey(g GetPubKey) {
+	n.mailbox.Lock()
+	id := n.findIdentity(g)
+	n.mailbox.Unlock()
+	if id == nil {
+		return
+	}
+	if t, ok := n.pubKeysPublished[id.Ripe]; ok && time.Since(t) < pubKeyPublishPeriod {
+		return
+	}
+	n.pubKeysPublished[id.Ripe] = time.Now()
+	log.Printf("publishing the pubkey of %v", id)
+	go func() {
+		payload, err := newPubKeyObject(id)
+		n.resp.powChan <- localObject{command: "pubkey", stream: id.Stream, payload: payload, err: err}
+	}()
+}
+
+// findIdentity returns our identity whose pubkey g requests, or nil. Version
+// 4 addresses are requested by their tag. The mailbox lock must be held.
+func (n *Node) findIdentity(g GetPubKey) *Identity {
+	if g.AddressVersion < 4 {
+		return n.mailbox.identities[g.PubKeyHash]
+	}
+	for _, id := range n.mailbox.identities {
+		if id.Version == g.AddressVersion && id.Stream == g.StreamNumber && id.tag() == g.Tag {
+			return id
+		}
+	}
+	return nil
+}
+
+// newPubKeyObject creates the signed pubkey object of id, with the proof of
+// work done. Version 4 pubkeys are also encrypted.
+func newPubKeyObject(id *Identity) ([]byte, error) {
+	k := id.PubKey()
+	if err := k.sign(id.SigningKey); err != nil {
+		return nil, err
+	}
+	if id.Version >= 4 {
+		if err := encryptPubKey(k, id.Address); err != nil {
+			return nil, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	writePubKey(buf, *k)
+	payload := buf.Bytes()
+	if err := doProofOfWork(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// composeMsg creates the msg object for out, including an ack if withAck is
+// set, and sends it to resp. The copy of the message content is used because
+// out can only be accessed while holding the mailbox lock.
+func composeMsg(from *Identity, to *PubKey, out *OutgoingMessage, content OutgoingMessage, withAck bool, resp chan localObject) {
+	o := localObject{command: "msg", stream: to.StreamNumber, out: out}
+	if !withAck {
+		o.payload, o.err = ComposeMsg(from, to, content.Encoding, content.Subject, content.Body, nil)
+		resp <- o
+		return
+	}
+	ack, err := newAck(to.StreamNumber)
+	if err != nil {
+		o.err = err
+		resp <- o
+		return
+	}
+	o.ackHash = inventoryHash(ack)
+	o.payload, o.err = ComposeMsg(from, to, content.Encoding, content.Subject, content.Body, encodeMessage("msg", ack))
+	resp <- o
+}
+
+// composeBroadcast creates the broadcast object for out and sends it to resp.
+func composeBroadcast(from *Identity, out *OutgoingMessage, content OutgoingMessage, resp chan localObject) {
+	o := localObject{command: "broadcast", stream: from.Stream, out: out}
+	o.payload, o.err = ComposeBroadcast(from, content.Encoding, content.Subject, content.Body)
+	resp <- o
+}
+
+// newAck creates the payload of a msg object that the recipient of one of our
+// messages sends back to the network to acknowledge it. Its content is random
+// so it can't be linked to the message.
+func newAck(stream uint64) ([]byte, error) {
+	m := msg{
+		Time:         uint64(time.Now().Unix()),
+		StreamNumber: stream,
+		Encrypted:    make([]byte, 32),
+	}
+	if _, err := rand.Read(m.Encrypted); err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	writeMsg(buf, m)
+	payload := buf.Bytes()
+	if err := doProofOfWork(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// powDone relays an object created by this node once its proof of work is
+// done.
+func (n *Node) powDone(o localObject) {
+	if o.err != nil {
+		log.Printf("could not create %v object: %v", o.command, o.err)
+		if o.out != nil {
+			n.mailbox.Lock()
+			o.out.setState(StateFailed)
+			n.mailbox.Unlock()
+		}
+		return
+	}
+	n.relayObject(o.stream, o.command, o.payload)
+	if o.out == nil {
+		return
+	}
+	// Our own objects are never downloaded from other nodes, so deliver it
+	// here in case it was sent to one of our identities or subscriptions.
+	switch o.command {
+	case "msg":
+		if m, err := parseMsg(bytes.NewBuffer(o.payload)); err == nil {
+			n.receiveMsg(m)
+		}
+	case "broadcast":
+		if b, err := parseBroadcast(bytes.NewBuffer(o.payload)); err == nil {
+			n.receiveBroadcast(b)
+		}
+	}
+	n.mailbox.Lock()
+	o.out.setState(StateSent)
+	if o.out.Broadcast || o.ackHash == (objHash{}) {
+		n.mailbox.Unlock()
+		return
+	}
+	if n.mailbox.acks == nil {
+		n.mailbox.acks = make(map[objHash]*OutgoingMessage)
+	}
+	n.mailbox.acks[o.ackHash] = o.out
+	n.mailbox.Unlock()
+}
+
+// checkAck marks the outgoing message acknowledged if h is the inventory hash
+// of its ack.
+func (n *Node) checkAck(h objHash) {
+	n.mailbox.Lock()
+	defer n.mailbox.Unlock()
+	if out, ok := n.mailbox.acks[h]; ok {
+		out.setState(StateAcknowledged)
+		delete(n.mailbox.acks, h)
+	}
+}
+
+// ComposeMsg creates a msg object from one of our identities to the owner of
+// a public key. The content is signed and encrypted, and the proof of work is
+// done, so the result is the payload of a "msg" message that can be relayed as
+// is. The proof of work takes a while, a few minutes for long messages, or
+// longer if the public key demands more than the network default.
+//
+// For EncodingSimple, the message has a subject and a body. Other encodings
+// only use the body. The ackData, if not empty, is a complete protocol message
+// that the recipient will send back to the network to acknowledge receipt.
+func ComposeMsg(from *Identity, to *PubKey, encoding uint64, subject, body string, ackData []byte) ([]byte, error) {
+	m, err := newMsg(from, to, encoding, subject, body, ackData)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	writeMsg(buf, m)
+	payload := buf.Bytes()
+	// Recipients drop msgs that don't meet the difficulty in their pubkey.
+	nonceTrialsPerByte, extraBytes := powDifficulty(to)
+	if err := doProofOfWorkFor(payload, nonceTrialsPerByte, extraBytes); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// newMsg creates a msg object with its content signed and encrypted, but
+// without the proof of work.
+func newMsg(from *Identity, to *PubKey, encoding uint64, subject, body string, ackData []byte) (m msg, err error) {
+	content := encodeContent(encoding, subject, body)
+	pub := from.PubKey()
+	d := &UnencryptedMessageData{
+		msgVersion:          1,
+		addressVersion:      from.Version,
+		streamNumber:        from.Stream,
+		behavior:            pub.Behavior,
+		publicSigningKey:    pub.PublicSigningKey,
+		publicEncryptionKey: pub.PublicEncryptionKey,
+		nonceTrialsPerByte:  pub.NonceTrialsPerByte,
+		extraBytes:          pub.ExtraBytes,
+		destinationRipe:     to.Address().Ripe,
+		encoding:            encoding,
+		messageLength:       uint64(len(content)),
+		message:             content,
+		ackLength:           uint64(len(ackData)),
+		ackData:             ackData,
+	}
+	if d.signature, err = sign(from.SigningKey, d.signedData()); err != nil {
+		return m, err
+	}
+	d.sigLength = uint64(len(d.signature))
+
+	plaintext := new(bytes.Buffer)
+	if err = writeUnencryptedMessageData(plaintext, d); err != nil {
+		return m, err
+	}
+	encryptionKey, err := pubKeyFromBytes(to.PublicEncryptionKey)
+	if err != nil {
+		return m, err
+	}
+	m.Time = uint64(time.Now().Unix())
+	m.StreamNumber = to.StreamNumber
+	m.Encrypted, err = encrypt(encryptionKey, plaintext.Bytes())
+	return m, err
+}
+
+// ComposeBroadcast creates a broadcast object from one of our identities. Like
+// ComposeMsg, the result is the payload of a "broadcast" message that can be
+// relayed as is.
+func ComposeBroadcast(from *Identity, encoding uint64, subject, body string) ([]byte, error) {
+	b, err := newBroadcast(from, encoding, subject, body)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = writeBroadcast(buf, b); err != nil {
+		return nil, err
+	}
+	payload := buf.Bytes()
+	if err := doProofOfWork(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// newBroadcast creates a version 2 broadcast from one of our identities, or a
+// version 3 broadcast for version 4 identities, with its content signed and
+// encrypted, but without the proof of work.
+func newBroadcast(from *Identity, encoding uint64, subject, body string) (b broadcast, err error) {
+	pub := from.PubKey()
+	b = broadcast{
+		Time:                uint64(time.Now().Unix()),
+		BroadcastVersion:    2,
+		Tag:                 pub.Tag,
+		AddressVersion:      from.Version,
+		StreamNumber:        from.Stream,
+		Behavior:            pub.Behavior,
+		PublicSigningKey:    pub.PublicSigningKey,
+		PublicEncryptionKey: pub.PublicEncryptionKey,
+		NonceTrialsPerByte:  pub.NonceTrialsPerByte,
+		ExtraBytes:          pub.ExtraBytes,
+		AddressHash:         from.Ripe,
+		Encoding:            encoding,
+		Message:             encodeContent(encoding, subject, body),
+	}
+	if from.Version >= 4 {
+		b.BroadcastVersion = 3
+	}
+	b.MessageLength = uint64(len(b.Message))
+	if b.Signature, err = sign(from.SigningKey, b.signedData()); err != nil {
+		return b, err
+	}
+	b.SigLength = uint64(len(b.Signature))
+	err = encryptBroadcast(&b, from.Address)
+	return b, err
+}
+
+// encodeContent is the inverse of newMessage.
+func encodeContent(encoding uint64, subject, body string) []byte {
+	if encoding == EncodingSimple {
+		// 'Subject:' + subject + '\n' + 'Body:' + message
+		return []byte("Subject:" + subject + "\nBody:" + body)
+	}
+	return []byte(body)
+}
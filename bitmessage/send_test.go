@@ -0,0 +1,174 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	from, err := NewDeterministicIdentity("bitz", streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := new(Node)
+	n.objects = newObjStore(NewMemoryObjectStore())
+	// Version 4 recipients are requested and found by their tag.
+	to := "BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r"
+	if _, err := n.Send(from.Address, to, EncodingSimple, "hello", "world"); err == nil {
+		t.Errorf("Send accepted a sender that isn't one of our identities")
+	}
+	n.AddIdentity(from)
+	if _, err := n.Send(from.Address, "BM-garbage", EncodingSimple, "hello", "world"); err == nil {
+		t.Errorf("Send accepted an invalid recipient")
+	}
+	id, err := n.Send(from.Address, to, EncodingSimple, "hello", "world")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	outbox := n.Outbox()
+	if len(outbox) != 1 || outbox[0].ID != id {
+		t.Fatalf("message %d not found in the outbox: %+v", id, outbox)
+	}
+	if outbox[0].State != StateAwaitingPubKey {
+		t.Errorf("wanted state %v, got %v", StateAwaitingPubKey, outbox[0].State)
+	}
+
+	// Pretend the proof of work was done. The message is sent and waits for
+	// the ack.
+	n.mailbox.outbox[0].setState(StateDoingPoW)
+	ack := objHash{1, 2, 3}
+	buf := new(bytes.Buffer)
+	writeMsg(buf, msg{StreamNumber: streamOne, Encrypted: []byte("fake")})
+	n.powDone(localObject{command: "msg", stream: streamOne, payload: buf.Bytes(), out: n.mailbox.outbox[0], ackHash: ack})
+	if s := n.Outbox()[0].State; s != StateSent {
+		t.Errorf("wanted state %v, got %v", StateSent, s)
+	}
+	n.checkAck(objHash{3, 2, 1})
+	if s := n.Outbox()[0].State; s != StateSent {
+		t.Errorf("unrelated ack changed the state to %v", s)
+	}
+	n.checkAck(ack)
+	if s := n.Outbox()[0].State; s != StateAcknowledged {
+		t.Errorf("wanted state %v, got %v", StateAcknowledged, s)
+	}
+}
+
+func TestSendAck(t *testing.T) {
+	from, err := NewDeterministicIdentity("bitz", streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewIdentity(streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A msg with valid proof of work, from TestParseMsg.
+	ack := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x14, 0x6b, 0x2a,
+		0x51, 0x7a, 0x4c, 0xc7, 0x01, 0x1f, 0x54, 0x9c,
+		0x27, 0x5e, 0x23, 0x96, 0x2c, 0x61, 0x09, 0xc0,
+		0xfb, 0xdb, 0x45, 0x4b, 0x7d, 0x63, 0xe9, 0x77,
+		0xa0, 0x3b, 0xaa, 0x8a, 0x67, 0x34, 0x8a, 0xa4,
+		0x9c, 0x09, 0xa1, 0xc7, 0xcb,
+	}
+	m, err := newMsg(from, to.PubKey(), EncodingSimple, "hello", "world", encodeMessage("msg", ack))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	n := new(Node)
+	n.objects = newObjStore(NewMemoryObjectStore())
+	n.connectedNodes = make(streamNodes)
+	n.addNode(streamOne, ipPort("127.0.0.1:8444"), remoteNode{conn: local})
+	n.AddIdentity(to)
+	n.receiveMsg(m)
+
+	// The recipient relays the ack to the network.
+	remote.SetDeadline(time.Now().Add(time.Second))
+	expectInv(t, remote, inventoryHash(ack))
+	if !n.objects.has(inventoryHash(ack)) {
+		t.Errorf("relayed ack was not stored")
+	}
+}
+
+// expectInv reads a message from r and checks that it's an inv of h.
+func expectInv(t *testing.T, r io.Reader, h objHash) {
+	relayed, err := readMessage(r)
+	if err != nil {
+		t.Fatalf("object was not relayed: %v", err)
+	}
+	if relayed.h.command != "inv" {
+		t.Fatalf("relayed with %v, wanted inv", relayed.h.command)
+	}
+	invs, err := parseInv(relayed.p)
+	if err != nil {
+		t.Fatalf("parseInv: %v", err)
+	}
+	if len(invs) != 1 || invs[0].Hash != h {
+		t.Errorf("advertised %x, wanted %x", invs, h)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	from, err := NewDeterministicIdentity("bitz", streamOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	n := new(Node)
+	n.objects = newObjStore(NewMemoryObjectStore())
+	n.connectedNodes = make(streamNodes)
+	n.addNode(streamOne, ipPort("127.0.0.1:8444"), remoteNode{conn: local})
+	if _, err := n.Broadcast(from.Address, EncodingSimple, "maintenance", "tonight"); err == nil {
+		t.Errorf("Broadcast accepted a sender that isn't one of our identities")
+	}
+	n.AddIdentity(from)
+	id, err := n.Broadcast(from.Address, EncodingSimple, "maintenance", "tonight")
+	if err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	outbox := n.Outbox()
+	if len(outbox) != 1 || outbox[0].ID != id || !outbox[0].Broadcast {
+		t.Fatalf("broadcast %d not found in the outbox: %+v", id, outbox)
+	}
+	if outbox[0].State != StateQueued {
+		t.Errorf("wanted state %v, got %v", StateQueued, outbox[0].State)
+	}
+
+	// Pretend the proof of work was done.
+	b, err := newBroadcast(from, EncodingSimple, "maintenance", "tonight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	writeBroadcast(buf, b)
+	n.mailbox.outbox[0].setState(StateDoingPoW)
+	n.powDone(localObject{command: "broadcast", stream: streamOne, payload: buf.Bytes(), out: n.mailbox.outbox[0]})
+	if s := n.Outbox()[0].State; s != StateSent {
+		t.Errorf("wanted state %v, got %v", StateSent, s)
+	}
+	remote.SetDeadline(time.Now().Add(time.Second))
+	expectInv(t, remote, inventoryHash(buf.Bytes()))
+}
@@ -17,18 +17,22 @@ package bitmessage
 // This file implements the main engine for this BitMessage node.
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"time"
-
-	"github.com/pmylund/go-bloom"
 )
 
 type Node struct {
-	// All members can only be accessed by the main server routine inside
-	// Run().
+	// Store keeps the objects relayed by the node. It can be set before
+	// calling Run. If nil, objects are kept on disk in the config directory.
+	Store ObjectStore
+	// All other members can only be accessed by the main server routine
+	// inside Run().
 	cfg *Config
 	// Stats. All access must be synchronized because it's often used by other
 	// goroutines (UI).
@@ -38,30 +42,76 @@ type Node struct {
 	// connectedNodes are all nodes we have a connection established to, for
 	// each stream.
 	connectedNodes streamNodes
-	// Bloomfilter of unreachable IPs.
-	// TODO: Rotate the filters and expire them.
-	// TODO: Save it on disk.
-	unreachableNodes *bloom.Filter
+	// unreachableNodes are nodes we failed to connect to several times in a
+	// row. They are not contacted until their entries expire.
+	unreachableNodes unreachableSet
+	// bannedNodes are the hosts banned for misbehaving, which we neither
+	// connect to nor accept connections from until their bans expire.
+	bannedNodes banSet
+	// banScores are the scores of the hosts that misbehaved and aren't
+	// banned yet.
+	banScores map[string]banScore
+	// inboundNodes are the nodes connected to us, including the ones that
+	// haven't finished the version exchange yet.
+	inboundNodes ipPortSet
+	// dialing are the nodes we are connecting to, which haven't finished the
+	// version exchange yet.
+	dialing map[ipPort]bool
 	// knownNodes are all nodes we know of for each stream number in
 	// addition to the connectedNodes.
 	knownNodes streamNodes
 	// objects provides information about which nodes holds each object.
 	// XXX this should be renamed to objectLocations or so.
 	objects *objStore
+	// mailbox holds our identities and the messages they received. Unlike
+	// the other members, it's synchronized and can be used by library users.
+	mailbox mailbox
+	// pubKeys are the public keys of other nodes we know of, indexed by the
+	// tag of their address. Version 4 pubkeys stay encrypted until their
+	// address is looked up.
+	pubKeys map[[32]byte]*PubKey
+	// pubKeyRequests is when we last sent a getpubkey for the address with
+	// each tag.
+	pubKeyRequests map[[32]byte]time.Time
+	// pubKeysPublished is when we last published the pubkey of each of our
+	// identities.
+	pubKeysPublished map[[20]byte]time.Time
 }
 
 func (n *Node) Run() {
 	n.connectedNodes = make(streamNodes)
 	n.knownNodes = make(streamNodes)
-	n.unreachableNodes = bloom.New(10000, 0.01)
+	n.dialing = make(map[ipPort]bool)
+	n.inboundNodes = make(ipPortSet)
+	n.pubKeys = make(map[[32]byte]*PubKey)
+	n.pubKeyRequests = make(map[[32]byte]time.Time)
+	n.pubKeysPublished = make(map[[20]byte]time.Time)
 
-	var err error
-	n.objects, err = createObjStore()
-	if err != nil {
-		log.Fatalln("Node fatal error:", err)
+	n.cfg = openConfig(PortNumber)
+	n.unreachableNodes = n.cfg.Unreachable
+	if n.unreachableNodes == nil {
+		n.unreachableNodes = make(unreachableSet)
 	}
+	n.unreachableNodes.expire()
+	n.bannedNodes = n.cfg.Banned
+	if n.bannedNodes == nil {
+		n.bannedNodes = make(banSet)
+	}
+	n.bannedNodes.expire()
+	n.banScores = make(map[string]banScore)
 
-	n.cfg = openConfig(PortNumber)
+	if n.Store == nil {
+		var err error
+		n.Store, err = NewDiskObjectStore(n.cfg.objectsPath())
+		if err != nil {
+			log.Fatalln("Node fatal error:", err)
+		}
+	}
+	n.objects = newObjStore(n.Store)
+	if err := n.objects.loadInventory(n.cfg.inventoryPath()); err != nil {
+		log.Println("loading the objects inventory:", err)
+	}
+	n.objects.expire()
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", PortNumber))
 	if err != nil {
@@ -72,95 +122,152 @@ func (n *Node) Run() {
 	go listen(listener.(*net.TCPListener), n.resp)
 	n.bootstrap()
 	saveTick := time.Tick(time.Minute * 1)
+	sendTick := time.Tick(outboxCheckPeriod)
+	addrTick := time.Tick(addrGossipPeriod)
+	expireTick := time.Tick(objectExpiryPeriod)
+	retryTick := time.Tick(getDataRetryPeriod)
+	peerTick := time.Tick(peerManagerPeriod)
 	for {
 		select {
+		case conn := <-n.resp.acceptChan:
+			n.accept(conn)
 		case addrs := <-n.resp.addrsChan:
 			log.Printf("nodesChan, got: %d nodes", len(addrs))
 			// Only connect to stream one for now.
-
-			needExtra := numNodesForMainStream - n.numStreamNodes(streamOne)
-			i := 0
-			// This is imprecise because I check the count of nodes using a
-			// metric that is only updated after the connection is
-			// established, not soon after a handshake goroutine is
-			// dispatched. That's fine, we'll just a have a few extra too may
-			// nodes.
-			log.Println("need extra", needExtra)
 			for _, addr := range addrs {
 				if addr.Stream != streamOne {
 					continue
 				}
-				if _, ok := n.connectedNodes[streamOne][addr.ipPort()]; ok {
-					continue
-				}
-				if n.unreachableNodes.Test(addr.IP[:]) {
+				if n.unreachableNodes.test(addr.ipPort()) {
 					continue
 				}
-				node := remoteNode{}
-				if i <= needExtra {
-					log.Println("handshaking with", addr.ipPort())
-					// Nodes for which the connection attempt fail won't even
-					// make it to n.knownNodes.
-					go handshake(addr.ipPort(), node, n.resp)
-					i++
-				} else {
-					n.addKnownNode(int(addr.Stream), addr.ipPort(), node)
-				}
+				n.learnNode(int(addr.Stream), addr.ipPort(), time.Unix(int64(addr.Time), 0))
 			}
+			n.managePeers()
 
-		case addr := <-n.resp.addNodeChan:
-			node := remoteNode{lastContacted: time.Now()}
-			n.addNode(int(addr.Stream), addr.ipPort(), node)
+		case c := <-n.resp.addNodeChan:
+			if n.banned(c.addr.ipPort()) {
+				// Banned while the version exchange was going on.
+				c.conn.Close()
+				break
+			}
+			node := remoteNode{conn: c.conn, lastContacted: time.Now(), inbound: c.inbound}
+			n.addNode(int(c.addr.Stream), c.addr.ipPort(), node)
+			if !c.inbound {
+				n.connected(int(c.addr.Stream), c.addr.ipPort())
+			}
+			go writeAddr(c.conn, n.goodNodes(int(c.addr.Stream), c.addr.ipPort()))
+			go writeInv(c.conn, n.objects.hashes(uint64(c.addr.Stream)))
 		case addr := <-n.resp.delNodeChan:
+			if n.dialing[addr.ipPort()] {
+				n.dialFailed(int(addr.Stream), addr.ipPort())
+			}
+			delete(n.inboundNodes, addr.ipPort())
 			n.delNode(int(addr.Stream), addr.ipPort())
-			n.unreachableNodes.Add(addr.IP[:])
-			// XXX if connection counter drops below numNodesforMainStream,
-			// get a node from knownNodes and promote it.
+			n.objects.dropNode(addr.ipPort())
+			n.managePeers()
+		case m := <-n.resp.misbehaviorChan:
+			n.misbehaved(m)
 		case i := <-n.resp.invChan:
-			n.objects.mergeInventory(i.inv, i.w)
-		case msg := <-n.resp.msgChan:
-			log.Printf("received message %+q", msg)
-			log.Printf("received message content: len=%d, content=%q \n====\n%x", len(msg.Encrypted), msg.Encrypted, msg.Encrypted)
-		//	log.Fatalln("done")
-		case broadcast := <-n.resp.broadcastChan:
-			//log.Printf("received broadcast %+q", broadcast)
-			log.Printf("received brodcast content: %v", string(broadcast.Message))
-			log.Fatalln("done")
+			n.objects.mergeInventory(i.inv, i.from, i.w)
+			for h := range i.inv.M {
+				n.checkAck(h)
+			}
+		case g := <-n.resp.getDataChan:
+			n.serveGetData(g)
+		case o := <-n.resp.objectChan:
+			n.acceptObject(o)
+		case o := <-n.resp.powChan:
+			n.powDone(o)
+		case <-sendTick:
+			n.processOutbox()
+		case <-addrTick:
+			n.gossipAddrs()
+		case <-expireTick:
+			n.objects.expire()
+			n.objects.inv.prune()
+			n.expirePubKeys()
+		case <-retryTick:
+			n.retryRequests()
+		case <-peerTick:
+			n.managePeers()
 		case <-saveTick:
-			n.cfg.save(n.connectedNodes)
+			n.unreachableNodes.expire()
+			n.bannedNodes.expire()
+			n.expireBanScores()
+			n.cfg.save(n.connectedNodes, n.unreachableNodes, n.bannedNodes)
+			if err := n.objects.saveInventory(n.cfg.inventoryPath()); err != nil {
+				log.Println("saving the objects inventory:", err)
+			}
 		}
 	}
 }
 
 // responses contains channels that are used by Node to receive data from the
 // network goroutines that are parsing the bitmessage protocol messages
-// from remote nodes.
+// from remote nodes, and from the goroutines doing proof of work for our own
+// objects.
 type responses struct {
-	addrsChan     chan []extendedNetworkAddress
-	addNodeChan   chan extendedNetworkAddress
-	delNodeChan   chan extendedNetworkAddress
-	invChan       chan nodeInv
-	msgChan       chan msg
-	broadcastChan chan broadcast
+	acceptChan      chan *net.TCPConn
+	addrsChan       chan []extendedNetworkAddress
+	addNodeChan     chan nodeConn
+	delNodeChan     chan extendedNetworkAddress
+	misbehaviorChan chan nodeMisbehavior
+	invChan         chan nodeInv
+	getDataChan     chan nodeGetData
+	objectChan      chan nodeObject
+	powChan         chan localObject
 }
 
 func newResponses() responses {
 	return responses{
+		make(chan *net.TCPConn),
 		make(chan []extendedNetworkAddress),
+		make(chan nodeConn),
 		make(chan extendedNetworkAddress),
-		make(chan extendedNetworkAddress),
+		make(chan nodeMisbehavior),
 		make(chan nodeInv),
-		make(chan msg),
-		make(chan broadcast),
+		make(chan nodeGetData),
+		make(chan nodeObject),
+		make(chan localObject),
 	}
 }
 
+// nodeConn is a connection to a remote node that went through the version
+// exchange.
+type nodeConn struct {
+	addr    extendedNetworkAddress
+	conn    net.Conn
+	inbound bool
+}
+
+// nodeObject is a valid object received from a remote node, to be stored and
+// advertised to the other nodes.
+type nodeObject struct {
+	from    ipPort
+	command string
+	stream  uint64
+	payload []byte
+	// object is the parsed msg, broadcast, GetPubKey or PubKey, which is
+	// only processed if the object is new.
+	object interface{}
+}
+
+// nodeGetData is a request from a remote node for the objects with the
+// provided hashes, to be written to w.
+type nodeGetData struct {
+	w      io.Writer
+	hashes []objHash
+}
+
 type packet struct {
 	b     []byte
 	raddr net.Addr
 }
 
 // Read from TCP , writes slice of byte into channel.
+// The connections are handed to the main server routine, which decides
+// whether to accept them.
 func listen(listener *net.TCPListener, resp responses) {
 	for {
 		conn, err := listener.AcceptTCP()
@@ -168,7 +275,7 @@ func listen(listener *net.TCPListener, resp responses) {
 			log.Fatal("Can't listen to network port:", err)
 			return
 		}
-		go handleConn(conn, resp)
+		resp.acceptChan <- conn
 	}
 }
 
@@ -177,19 +284,58 @@ type peerState struct {
 	verackSent     bool
 	verackReceived bool
 	ipPort         ipPort
+	conn           net.Conn
+	// inbound is set if the remote node connected to us. Its ipPort then
+	// has an ephemeral port, not the one it listens on.
+	inbound bool
+	// served is the number of objects requested with getdata since
+	// servedSince, used to limit how fast we serve this node.
+	served      int
+	servedSince time.Time
 }
 
-func handleConn(conn *net.TCPConn, resp responses) {
+// getDataAllowance returns how many of n requested objects can be served to
+// the node now, and counts them as served.
+func (p *peerState) getDataAllowance(n int) int {
+	if time.Since(p.servedSince) >= time.Second {
+		p.served = 0
+		p.servedSince = time.Now()
+	}
+	if n > maxGetDataServedPerRequest {
+		n = maxGetDataServedPerRequest
+	}
+	if left := maxGetDataServedPerSecond - p.served; n > left {
+		n = left
+	}
+	p.served += n
+	return n
+}
+
+// errNotEstablished is returned for messages that can only be sent after the
+// version exchange.
+var errNotEstablished = misbehaving(banScoreUnsolicited, errors.New("version unknown. Closing connection"))
+
+func handleConn(conn *net.TCPConn, inbound bool, resp responses) {
 	defer conn.Close()
 
-	p := &peerState{}
+	p := &peerState{conn: conn, inbound: inbound}
 	p.ipPort = ipPort(conn.RemoteAddr().String())
+	handshakeDeadline := time.Now().Add(HandshakeTimeout)
 	for {
 
-		conn.SetDeadline(time.Now().Add(connectionTimeout))
+		// Nodes that keep sending data can't stay in the version exchange
+		// past HandshakeTimeout.
+		deadline := time.Now().Add(connectionTimeout)
+		if !p.established && handshakeDeadline.Before(deadline) {
+			deadline = handshakeDeadline
+		}
+		conn.SetDeadline(deadline)
 		m, err := readMessage(conn)
 		if err != nil {
 			log.Println("handleConn:", err)
+			if score := misbehaviorScore(err); score > 0 {
+				resp.misbehaviorChan <- nodeMisbehavior{p.ipPort, score}
+			}
 			resp.delNodeChan <- p.ipPort.toNetworkAddress()
 			return
 		}
@@ -206,10 +352,16 @@ func handleConn(conn *net.TCPConn, resp responses) {
 			err = handleVerack(conn, p, resp.addNodeChan)
 		case "inv":
 			err = handleInv(conn, p, m, resp.invChan)
+		case "getdata":
+			err = handleGetData(conn, p, m, resp.getDataChan)
 		case "msg":
-			err = handleMsg(conn, p, m, resp.msgChan)
+			err = handleMsg(conn, p, m, resp.objectChan)
 		case "broadcast":
-			err = handleBroadcast(conn, p, m, resp.broadcastChan)
+			err = handleBroadcast(conn, p, m, resp.objectChan)
+		case "getpubkey":
+			err = handleGetPubKey(conn, p, m, resp.objectChan)
+		case "pubkey":
+			err = handlePubKey(conn, p, m, resp.objectChan)
 		default:
 			// XXX
 			err = fmt.Errorf("ignoring unknown command %q", command)
@@ -222,6 +374,9 @@ func handleConn(conn *net.TCPConn, resp responses) {
 
 		if err != nil {
 			log.Printf("error while processing command %v: %v", command, err)
+			if score := misbehaviorScore(err); score > 0 {
+				resp.misbehaviorChan <- nodeMisbehavior{p.ipPort, score}
+			}
 			resp.delNodeChan <- ipPort(conn.RemoteAddr().String()).toNetworkAddress()
 			// Disconnects from node.
 			return
@@ -229,9 +384,9 @@ func handleConn(conn *net.TCPConn, resp responses) {
 	}
 }
 
-func handleVersion(conn io.Writer, p *peerState, m *message, addNode chan extendedNetworkAddress) error {
-	if p.established {
-		return fmt.Errorf("received a 'version' message from a host we already went through a version exchange. Closing the connection.")
+func handleVersion(conn io.Writer, p *peerState, m *message, addNode chan nodeConn) error {
+	if p.verackSent {
+		return misbehaving(banScoreDuplicateHandshake, fmt.Errorf("received a 'version' message from a host we already went through a version exchange. Closing the connection."))
 	}
 	version, err := parseVersion(m.p)
 	if err != nil {
@@ -251,26 +406,26 @@ func handleVersion(conn io.Writer, p *peerState, m *message, addNode chan extend
 	p.verackSent = true
 	if p.verackReceived {
 		p.established = true
-		addNode <- p.ipPort.toNetworkAddress()
+		addNode <- nodeConn{p.ipPort.toNetworkAddress(), p.conn, p.inbound}
 	}
 	return nil
 }
 
-func handleVerack(conn io.Writer, p *peerState, addNode chan extendedNetworkAddress) error {
+func handleVerack(conn io.Writer, p *peerState, addNode chan nodeConn) error {
 	if p.verackReceived {
-		return fmt.Errorf("received 'verack' twice from a node. Closing connection")
+		return misbehaving(banScoreDuplicateHandshake, fmt.Errorf("received 'verack' twice from a node. Closing connection"))
 	}
 	p.verackReceived = true
 	if p.verackSent {
 		p.established = true
-		addNode <- p.ipPort.toNetworkAddress()
+		addNode <- nodeConn{p.ipPort.toNetworkAddress(), p.conn, p.inbound}
 	}
 	return nil
 }
 
 func handleAddr(conn io.Writer, p *peerState, m *message, respNodes chan []extendedNetworkAddress) error {
 	if !p.established {
-		return fmt.Errorf("version unknown. Closing connection")
+		return errNotEstablished
 	}
 	addrs, err := parseAddr(m.p)
 	if err != nil {
@@ -284,7 +439,7 @@ var i = 0
 
 func handleInv(conn io.Writer, p *peerState, m *message, obj chan nodeInv) error {
 	if !p.established {
-		return fmt.Errorf("version unknown. Closing connection")
+		return errNotEstablished
 	}
 	invs, err := parseInv(m.p)
 	if err != nil {
@@ -294,31 +449,96 @@ func handleInv(conn io.Writer, p *peerState, m *message, obj chan nodeInv) error
 	for _, inv := range invs {
 		nodeObjects.add(inv.Hash, p.ipPort)
 	}
-	obj <- nodeInv{conn, *nodeObjects}
+	obj <- nodeInv{p.ipPort, conn, *nodeObjects}
 	return nil
 }
 
-func handleMsg(conn io.Writer, p *peerState, m *message, msgChan chan msg) error {
+func handleGetData(conn io.Writer, p *peerState, m *message, getDataChan chan nodeGetData) error {
 	if !p.established {
-		return fmt.Errorf("version unknown. Closing connection")
+		return errNotEstablished
 	}
-	msg, err := parseMsg(m.p)
+	invs, err := parseInv(m.p)
+	if err != nil {
+		return fmt.Errorf("parseInv error: %v. Closing connection", err)
+	}
+	// Objects beyond the allowance are dropped. The node can ask for them
+	// again later.
+	n := p.getDataAllowance(len(invs))
+	if n < len(invs) {
+		log.Printf("handleGetData: serving only %d of the %d objects requested by %v", n, len(invs), p.ipPort)
+	}
+	if n == 0 {
+		return nil
+	}
+	hashes := make([]objHash, n)
+	for i := range hashes {
+		hashes[i] = invs[i].Hash
+	}
+	getDataChan <- nodeGetData{conn, hashes}
+	return nil
+}
+
+func handleMsg(conn io.Writer, p *peerState, m *message, objChan chan nodeObject) error {
+	if !p.established {
+		return errNotEstablished
+	}
+	payload, err := ioutil.ReadAll(m.p)
+	if err != nil {
+		return err
+	}
+	msg, err := parseMsg(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("handleMsg parseMsg error: %w. Closing connection", err)
+	}
+	objChan <- nodeObject{p.ipPort, "msg", msg.StreamNumber, payload, msg}
+	return nil
+}
+
+func handleBroadcast(conn io.Writer, p *peerState, m *message, objChan chan nodeObject) error {
+	if !p.established {
+		return errNotEstablished
+	}
+	payload, err := ioutil.ReadAll(m.p)
 	if err != nil {
-		return fmt.Errorf("handleMsg parseMsg error: %v. Closing connection", err)
+		return err
 	}
-	msgChan <- msg
+	b, err := parseBroadcast(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("handleBroadcast parseBroadcast error: %w. Closing connection", err)
+	}
+	objChan <- nodeObject{p.ipPort, "broadcast", b.StreamNumber, payload, b}
 	return nil
 }
 
-func handleBroadcast(conn io.Writer, p *peerState, m *message, bChan chan broadcast) error {
+func handleGetPubKey(conn io.Writer, p *peerState, m *message, objChan chan nodeObject) error {
 	if !p.established {
-		return fmt.Errorf("version unknown. Closing connection")
+		return errNotEstablished
+	}
+	payload, err := ioutil.ReadAll(m.p)
+	if err != nil {
+		return err
+	}
+	g, err := parseGetPubKey(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("handleGetPubKey parseGetPubKey error: %w. Closing connection", err)
+	}
+	objChan <- nodeObject{p.ipPort, "getpubkey", g.StreamNumber, payload, g}
+	return nil
+}
+
+func handlePubKey(conn io.Writer, p *peerState, m *message, objChan chan nodeObject) error {
+	if !p.established {
+		return errNotEstablished
+	}
+	payload, err := ioutil.ReadAll(m.p)
+	if err != nil {
+		return err
 	}
-	b, err := parseBroadcast(m.p)
+	k, err := parsePubKey(bytes.NewReader(payload))
 	if err != nil {
-		return fmt.Errorf("handleBroadcast parseBroadcast error: %v. Closing connection", err)
+		return fmt.Errorf("handlePubKey parsePubKey error: %w. Closing connection", err)
 	}
-	bChan <- b
+	objChan <- nodeObject{p.ipPort, "pubkey", k.StreamNumber, payload, k}
 	return nil
 }
 
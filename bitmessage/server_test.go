@@ -0,0 +1,69 @@
+//  Copyright 2013 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package bitmessage
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetDataAllowance(t *testing.T) {
+	p := &peerState{}
+	if n := p.getDataAllowance(maxGetDataServedPerRequest + 1); n != maxGetDataServedPerRequest {
+		t.Errorf("first request: got %d, wanted %d", n, maxGetDataServedPerRequest)
+	}
+	served := maxGetDataServedPerRequest
+	for served < maxGetDataServedPerSecond {
+		served += p.getDataAllowance(maxGetDataServedPerRequest)
+	}
+	if served != maxGetDataServedPerSecond {
+		t.Errorf("served %d objects in one second, wanted %d", served, maxGetDataServedPerSecond)
+	}
+	if n := p.getDataAllowance(1); n != 0 {
+		t.Errorf("request beyond the per second limit: got %d, wanted 0", n)
+	}
+	p.servedSince = time.Now().Add(-time.Second)
+	if n := p.getDataAllowance(1); n != 1 {
+		t.Errorf("request after a second: got %d, wanted 1", n)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	defer func(d time.Duration) { HandshakeTimeout = d }(HandshakeTimeout)
+	HandshakeTimeout = 50 * time.Millisecond
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remote, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := newResponses()
+	go handleConn(conn, true, resp)
+	select {
+	case <-resp.delNodeChan:
+	case <-time.After(connectionTimeout / 2):
+		t.Fatalf("connection without a version exchange wasn't dropped after HandshakeTimeout")
+	}
+}
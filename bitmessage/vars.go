@@ -57,12 +57,82 @@ const (
 	prefix           = "bitmessage"
 
 	nodeConnectionRetryPeriod            = time.Minute * 30
+	connectionRetryBackoff               = time.Minute
+	maxConnectionFailures                = 5
+	peerManagerPeriod                    = time.Second * 30
+	unreachableNodeTTL                   = time.Hour * 24
 	connectionTimeout                    = time.Second * 10
 	numNodesForMainStream                = 15
 	maxInventoryEntries                  = 50000
 	payloadLengthExtraBytes              = 14000
 	averageProofOfWorkNonceTrialsPerByte = 320
 
+	// How often the outbox is checked for messages whose recipient's
+	// pubkey became available.
+	outboxCheckPeriod = time.Second * 5
+	// How long to wait for a pubkey before requesting it again.
+	getPubKeyRetryPeriod = time.Hour * 12
+	// Minimum interval between publishing the pubkey of one of our
+	// identities, no matter how many getpubkey requests arrive.
+	pubKeyPublishPeriod = time.Hour * 24
+	// Maximum number of pubkeys of other nodes kept in memory. The oldest
+	// are evicted first.
+	maxCachedPubKeys = 10000
+
+	// Maximum number of entries in an addr message.
+	maxAddrEntries = 1000
+	// How often the addresses of good nodes are sent to connected nodes.
+	addrGossipPeriod = time.Minute * 30
+	// Known nodes not contacted for this long are not advertised.
+	addrStaleAge = time.Hour * 3
+
+	// How long to wait for an object requested with getdata before asking
+	// another node that has it.
+	getDataTimeout = time.Minute
+	// Maximum number of getdata messages sent to a node whose objects didn't
+	// all arrive yet. Each asks for up to maxGetDataServedPerRequest objects,
+	// so this keeps us within what a node serves per second. More requests
+	// are queued until a batch is answered.
+	getDataWindow = maxGetDataServedPerSecond / maxGetDataServedPerRequest
+	// Maximum number of times an object is requested before giving up until
+	// it's advertised again.
+	maxGetDataAttempts = 3
+	// How long the nodes asked for an object can still send it after its
+	// request was answered or abandoned, without being taken for
+	// unsolicited.
+	getDataGracePeriod = time.Minute * 10
+	// How often timed out getdata requests are checked, and queued ones
+	// sent.
+	getDataRetryPeriod = time.Second * 10
+	// Maximum number of objects sent in reply to a single getdata message.
+	maxGetDataServedPerRequest = 500
+	// Maximum number of objects sent to a node per second, in reply to all
+	// its getdata messages.
+	maxGetDataServedPerSecond = 1000
+
+	// Objects older than their lifetime are neither accepted nor
+	// advertised. This is the lifetime of all objects except pubkeys.
+	maxObjectAge = time.Hour * 48
+	// Pubkeys are kept for longer than other objects, so we can still send
+	// messages to nodes that published them a while ago.
+	pubKeyLifetime = time.Hour * 24 * 28
+	// How often expired objects are deleted from the store.
+	objectExpiryPeriod = time.Hour
+	// How far in the future the time of an accepted object can be, to
+	// allow for clock differences.
+	maxObjectClockSkew = time.Hour * 3
+
+	// Ban score that gets a host banned for BanDuration.
+	banThreshold = 100
+	// Ban score added for each kind of misbehavior.
+	banScoreInvalidPoW         = 50
+	banScoreOversizePayload    = 50
+	banScoreBadChecksum        = 20
+	banScoreDuplicateHandshake = 20
+	banScoreUnsolicited        = 10
+	// Ban scores of hosts that didn't misbehave for this long are forgotten.
+	banScoreTTL = time.Hour * 24
+
 	// This is a normal network node.
 	ConnectionServiceNodeNetwork = 1
 )
@@ -70,6 +140,20 @@ const (
 var (
 	// PortNumber can be safely changed before the call to node.Run().
 	PortNumber = 9090
+	// BanDuration is how long misbehaving hosts are banned for. It can be
+	// safely changed before the call to node.Run().
+	BanDuration = time.Hour * 24
+
+	// Limits for the connections other nodes make to us, including the ones
+	// still in the version exchange. Subnets are /16 for IPv4. They can be
+	// safely changed before the call to node.Run().
+	MaxInboundPeers          = 125
+	MaxInboundPeersPerIP     = 2
+	MaxInboundPeersPerSubnet = 8
+	// HandshakeTimeout is how long a node has to complete the version
+	// exchange after the connection is made, no matter how often it sends
+	// data. It can be safely changed before the call to node.Run().
+	HandshakeTimeout = time.Second * 30
 
 	// Magic value indicating message origin network, and used to seek to next
 	// message when stream state is unknown.